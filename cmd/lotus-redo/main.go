@@ -53,6 +53,8 @@ func main() {
 				Usage: "num run in parallel",
 				Value: 1,
 			},
+			util.TipSetFlag,
+			util.HeightFlag,
 		},
 		EnableBashCompletion: true,
 		Action: func(cctx *cli.Context) error {
@@ -82,7 +84,12 @@ func redo(cctx *cli.Context) error {
 		return err
 	}
 
-	sectorSize, nv, err := util.GetSectorSize(context.Background(), nodeApi, maddr)
+	ts, err := util.GetTipSet(context.Background(), cctx, nodeApi)
+	if err != nil {
+		return err
+	}
+
+	sectorSize, nv, err := util.GetSectorSizeAt(context.Background(), nodeApi, maddr, ts.Key())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	alertFailing  = "failing"
+	alertResolved = "resolved"
+)
+
+var (
+	alertWebhookFlag = &cli.StringFlag{
+		Name:  "alert-webhook",
+		Usage: "post alerts as json to this http url",
+	}
+	alertExecFlag = &cli.StringFlag{
+		Name:  "alert-exec",
+		Usage: "run this command through 'sh -c' for alerts, the json payload is written to its stdin",
+	}
+	alertFileFlag = &cli.StringFlag{
+		Name:  "alert-file",
+		Usage: "append alerts as json lines to this file",
+	}
+	alertStateFlag = &cli.StringFlag{
+		Name:  "alert-state",
+		Usage: "file remembering the sectors already alerted, so that repeated runs don't alert twice",
+	}
+)
+
+type alertEvent struct {
+	Kind      string    `json:"kind"`
+	Miner     string    `json:"miner"`
+	Deadline  int       `json:"deadline"`
+	Partition int       `json:"partition"`
+	Sector    uint64    `json:"sector"`
+	Status    string    `json:"status"`
+	SealedDir string    `json:"sealed_dir"`
+	CacheDir  string    `json:"cache_dir"`
+	Since     time.Time `json:"since"`
+	Time      time.Time `json:"time"`
+}
+
+type alertPayload struct {
+	Events []alertEvent `json:"events"`
+}
+
+type alertSink interface {
+	send(ctx context.Context, payload []byte) error
+}
+
+type webhookSink struct {
+	url string
+}
+
+func (s *webhookSink) send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("posting alert to %s: %w", s.url, err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return xerrors.Errorf("posting alert to %s: %s: %s", s.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+type commandSink struct {
+	command string
+}
+
+func (s *commandSink) send(ctx context.Context, payload []byte) error {
+	var errOut bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.command) // nolint
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &errOut
+	if err := cmd.Run(); err != nil {
+		return xerrors.Errorf("exec alert command (stderr: %s): %w", strings.TrimSpace(errOut.String()), err)
+	}
+	return nil
+}
+
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) send(_ context.Context, payload []byte) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var line bytes.Buffer
+	if err := json.Compact(&line, payload); err != nil {
+		_ = f.Close()
+		return err
+	}
+	line.WriteByte('\n')
+
+	if _, err := f.Write(line.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// alerter sends an alert when a sector starts failing and when it recovers.
+// Sectors which keep failing are only alerted once.
+type alerter struct {
+	sinks     []alertSink
+	statePath string
+
+	lk      sync.Mutex
+	failing map[string]alertEvent
+}
+
+// newAlerter returns nil if no alert sink is configured.
+func newAlerter(cctx *cli.Context) (*alerter, error) {
+	a := &alerter{
+		statePath: cctx.String(alertStateFlag.Name),
+		failing:   map[string]alertEvent{},
+	}
+
+	if url := cctx.String(alertWebhookFlag.Name); url != "" {
+		a.sinks = append(a.sinks, &webhookSink{url: url})
+	}
+	if command := cctx.String(alertExecFlag.Name); command != "" {
+		a.sinks = append(a.sinks, &commandSink{command: command})
+	}
+	if path := cctx.String(alertFileFlag.Name); path != "" {
+		a.sinks = append(a.sinks, &fileSink{path: path})
+	}
+
+	if len(a.sinks) == 0 {
+		return nil, nil
+	}
+
+	if a.statePath != "" {
+		b, err := ioutil.ReadFile(a.statePath)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, xerrors.Errorf("reading alert state: %w", err)
+		default:
+			if err := json.Unmarshal(b, &a.failing); err != nil {
+				return nil, xerrors.Errorf("decoding alert state %s: %w", a.statePath, err)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+func alertKey(miner string, sector uint64) string {
+	return fmt.Sprintf("%s/%d", miner, sector)
+}
+
+// process alerts the sectors of the report which started failing or which
+// recovered since the previous report.
+func (a *alerter) process(ctx context.Context, rep *report) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	now := time.Now()
+
+	var events []alertEvent
+	for _, s := range rep.Sectors {
+		key := alertKey(s.Miner, s.Sector)
+		prev, alerted := a.failing[key]
+
+		if s.Status == statusOK {
+			if alerted {
+				prev.Kind = alertResolved
+				prev.Status = s.Status
+				prev.Time = now
+				events = append(events, prev)
+				delete(a.failing, key)
+			}
+			continue
+		}
+
+		if alerted && prev.Status == s.Status {
+			continue
+		}
+
+		ev := alertEvent{
+			Kind:      alertFailing,
+			Miner:     s.Miner,
+			Deadline:  s.Deadline,
+			Partition: s.Partition,
+			Sector:    s.Sector,
+			Status:    s.Status,
+			SealedDir: s.SealedDir,
+			CacheDir:  s.CacheDir,
+			Since:     now,
+			Time:      now,
+		}
+		if alerted {
+			ev.Since = prev.Since
+		}
+
+		events = append(events, ev)
+		a.failing[key] = ev
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(alertPayload{Events: events})
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, sink := range a.sinks {
+		if err := sink.send(ctx, payload); err != nil {
+			log.Errorw("sending alert failed", "err", err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err := a.save(); err != nil {
+		return err
+	}
+
+	if len(errs) != 0 {
+		return xerrors.Errorf("sending alerts: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (a *alerter) save() error {
+	if a.statePath == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(a.failing)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(a.statePath, b, 0644); err != nil {
+		return xerrors.Errorf("writing alert state: %w", err)
+	}
+	return nil
+}
+
+// notifyReport sends alerts for the report if any alert sink is configured.
+func notifyReport(cctx *cli.Context, rep *report) error {
+	a, err := newAlerter(cctx)
+	if err != nil || a == nil {
+		return err
+	}
+
+	return a.process(lcli.ReqContext(cctx), rep)
+}
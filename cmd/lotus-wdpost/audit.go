@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/extern/sector-storage/ffiwrapper"
+	builtin2 "github.com/filecoin-project/specs-actors/v2/actors/builtin"
+	miner2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
+	miner3 "github.com/filecoin-project/specs-actors/v3/actors/builtin/miner"
+	adt3 "github.com/filecoin-project/specs-actors/v3/actors/util/adt"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const (
+	auditValid   = "valid"
+	auditInvalid = "invalid"
+	auditError   = "error"
+)
+
+// postAudit is the result of verifying one SubmitWindowedPoSt message again.
+// An invalid proof can be disputed with DisputeWindowedPoSt(Deadline,
+// PoStIndex) until DisputableUntil. PoStIndex is not set for proofs the
+// deadline didn't record, which were verified on chain and can't be
+// disputed.
+type postAudit struct {
+	Miner           string         `json:"miner"`
+	Message         string         `json:"message"`
+	Height          abi.ChainEpoch `json:"height"`
+	Deadline        uint64         `json:"deadline"`
+	Open            abi.ChainEpoch `json:"open"`
+	PoStIndex       *uint64        `json:"post_index,omitempty"`
+	Partitions      []uint64       `json:"partitions"`
+	Sectors         int            `json:"sectors"`
+	Status          string         `json:"status"`
+	DisputableUntil abi.ChainEpoch `json:"disputable_until"`
+	Error           string         `json:"error,omitempty"`
+
+	// proofs of the message, to find it among the recorded ones
+	proofs string
+}
+
+// postSubmission is a SubmitWindowedPoSt message which was executed
+// successfully, along with the tipset it was included in.
+type postSubmission struct {
+	msg    string
+	ts     *types.TipSet
+	params miner2.SubmitWindowedPoStParams
+}
+
+var auditCmd = &cli.Command{
+	Name:  "audit",
+	Usage: "verify again the SubmitWindowedPoSt messages of a miner in a range of epochs",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor id, any miner can be audited",
+		},
+		&cli.Int64Flag{
+			Name:  "from",
+			Usage: "first epoch of the range, by default one proving period before --to",
+		},
+		&cli.Int64Flag{
+			Name:  "to",
+			Usage: "last epoch of the range, by default the chain ts",
+		},
+		&cli.IntFlag{
+			Name:  "deadline",
+			Usage: "only audit this deadline",
+			Value: -1,
+		},
+		&cli.BoolFlag{
+			Name:  "invalid-only",
+			Usage: "only list invalid proofs",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: json or table",
+			Value: "table",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		output := cctx.String("output")
+		if output != "json" && output != "table" {
+			return xerrors.Errorf("unknown --output format: %s", output)
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ctx := lcli.ReqContext(cctx)
+
+		if !cctx.IsSet("actor") {
+			return xerrors.New("--actor is required")
+		}
+		maddr, err := addr.NewFromString(cctx.String("actor"))
+		if err != nil {
+			return err
+		}
+
+		// proofs, and their index in the deadline, are read up to the tipset
+		ts, err := util.GetTipSet(ctx, cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		// messages are matched by the id address of the miner
+		maddr, err = nodeApi.StateLookupID(ctx, maddr, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("looking up miner id: %w", err)
+		}
+
+		to := ts.Height()
+		if cctx.IsSet("to") {
+			to = abi.ChainEpoch(cctx.Int64("to"))
+		}
+		if to > ts.Height() {
+			return xerrors.Errorf("--to %d is above the tipset at %d", to, ts.Height())
+		}
+		from := to - policy.GetWPoStChallengeWindow()*abi.ChainEpoch(policy.GetWPoStPeriodDeadlines())
+		if cctx.IsSet("from") {
+			from = abi.ChainEpoch(cctx.Int64("from"))
+		}
+		if from > to {
+			return xerrors.New("--from must not be after --to")
+		}
+
+		subs, err := findPoStSubmissions(ctx, nodeApi, maddr, from, to, ts)
+		if err != nil {
+			return err
+		}
+
+		// recorded proofs of each deadline window, by their proofs
+		indexes := map[postWindow]map[string]uint64{}
+
+		var audits []postAudit
+		for _, sub := range subs {
+			if dl := cctx.Int("deadline"); dl >= 0 && sub.params.Deadline != uint64(dl) {
+				continue
+			}
+
+			a := auditSubmission(ctx, nodeApi, maddr, sub)
+			if a.Status == auditValid && cctx.Bool("invalid-only") {
+				continue
+			}
+
+			w := postWindow{deadline: a.Deadline, open: a.Open}
+			idx, ok := indexes[w]
+			if !ok {
+				if idx, err = postIndexes(ctx, nodeApi, maddr, w, ts); err != nil {
+					log.Warnw("reading the recorded proofs of the deadline", "deadline", w.deadline, "open", w.open, "err", err)
+				}
+				indexes[w] = idx
+			}
+			if i, ok := idx[a.proofs]; ok {
+				a.PoStIndex = &i
+			}
+
+			if a.Status != auditValid {
+				log.Warnw("proof did not verify", "message", a.Message, "deadline", a.Deadline, "post index", a.postIndex(), "status", a.Status, "err", a.Error)
+			}
+			audits = append(audits, a)
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(audits)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "HEIGHT\tMESSAGE\tDEADLINE\tPOST INDEX\tPARTITIONS\tSECTORS\tSTATUS\tDISPUTABLE UNTIL\tERROR")
+		for _, a := range audits {
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%v\t%d\t%s\t%d\t%s\n", a.Height, a.Message, a.Deadline, a.postIndex(), a.Partitions, a.Sectors, a.Status, a.DisputableUntil, a.Error)
+		}
+		return tw.Flush()
+	},
+}
+
+func (a *postAudit) postIndex() string {
+	if a.PoStIndex == nil {
+		return "-"
+	}
+	return strconv.FormatUint(*a.PoStIndex, 10)
+}
+
+// postKey identifies a submission among the recorded ones by its proofs.
+func postKey(proofs ...[]byte) string {
+	return string(bytes.Join(proofs, nil))
+}
+
+// postIndexes returns the index of each proof recorded by the deadline in
+// the window, in OptimisticPoStSubmissions while the window is open and in
+// its snapshot once it has closed, keyed by postKey. Submissions which
+// recovered power were verified on chain and are not recorded, so they are
+// not numbered.
+func postIndexes(ctx context.Context, nodeApi api.FullNode, maddr addr.Address, w postWindow, head *types.TipSet) (map[string]uint64, error) {
+	closeAt := w.open + policy.GetWPoStChallengeWindow()
+	closed := head.Height() >= closeAt
+
+	// the snapshot is taken by the cron in the last epoch of the deadline,
+	// so it is in the state of the first tipset from close, and kept until
+	// the deadline closes again a proving period later
+	ts := head
+	if closed {
+		var err error
+		if ts, err = nodeApi.ChainGetTipSetAfterHeight(ctx, closeAt, head.Key()); err != nil {
+			return nil, xerrors.Errorf("getting tipset after the deadline closed: %w", err)
+		}
+	}
+
+	mas, err := loadMinerState(nodeApi, maddr, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	dl, err := mas.LoadDeadline(w.deadline)
+	if err != nil {
+		return nil, xerrors.Errorf("loading deadline %d: %w", w.deadline, err)
+	}
+
+	// the lotus wrapper doesn't expose the submissions, the deadline is
+	// decoded again with its specs-actors layout
+	m, ok := dl.(interface{ MarshalCBOR(io.Writer) error })
+	if !ok {
+		return nil, xerrors.Errorf("deadline state %T can't be encoded", dl)
+	}
+	buf := new(bytes.Buffer)
+	if err := m.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	var raw miner3.Deadline
+	if err := raw.UnmarshalCBOR(buf); err != nil {
+		return nil, xerrors.Errorf("decoding deadline %d: %w", w.deadline, err)
+	}
+
+	root := raw.OptimisticPoStSubmissions
+	if closed {
+		root = raw.OptimisticPoStSubmissionsSnapshot
+	}
+
+	store := adt.WrapStore(ctx, cbor.NewCborStore(blockstore.NewAPIBlockstore(nodeApi)))
+	arr, err := adt3.AsArray(store, root, miner3.DeadlineOptimisticPoStSubmissionsAmtBitwidth)
+	if err != nil {
+		return nil, xerrors.Errorf("loading submissions of deadline %d: %w", w.deadline, err)
+	}
+
+	out := map[string]uint64{}
+	var post miner3.WindowedPoSt
+	err = arr.ForEach(&post, func(i int64) error {
+		proofs := make([][]byte, 0, len(post.Proofs))
+		for _, p := range post.Proofs {
+			proofs = append(proofs, p.ProofBytes)
+		}
+		out[postKey(proofs...)] = uint64(i)
+		return nil
+	})
+	return out, err
+}
+
+// findPoStSubmissions returns the successful SubmitWindowedPoSt messages of
+// the miner included between from and to, in execution order.
+func findPoStSubmissions(ctx context.Context, nodeApi api.FullNode, maddr addr.Address, from, to abi.ChainEpoch, head *types.TipSet) ([]postSubmission, error) {
+	var err error
+
+	// the messages of a tipset are executed, and their receipts known, in
+	// the child tipset
+	ts := head
+	if to < head.Height() {
+		ts, err = nodeApi.ChainGetTipSetByHeight(ctx, to+1, head.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("getting tipset at %d: %w", to+1, err)
+		}
+	}
+
+	var subs []postSubmission
+	for ts.Height() > from {
+		pts, err := nodeApi.ChainGetTipSet(ctx, ts.Parents())
+		if err != nil {
+			return nil, err
+		}
+		if pts.Height() < from {
+			break
+		}
+
+		msgs, err := nodeApi.ChainGetParentMessages(ctx, ts.Cids()[0])
+		if err != nil {
+			return nil, xerrors.Errorf("getting messages of %d: %w", pts.Height(), err)
+		}
+		rcpts, err := nodeApi.ChainGetParentReceipts(ctx, ts.Cids()[0])
+		if err != nil {
+			return nil, xerrors.Errorf("getting receipts of %d: %w", pts.Height(), err)
+		}
+
+		var found []postSubmission
+		for i, m := range msgs {
+			if m.Message.Method != builtin2.MethodsMiner.SubmitWindowedPoSt {
+				continue
+			}
+			dest := m.Message.To
+			if dest.Protocol() != addr.ID {
+				if dest, err = nodeApi.StateLookupID(ctx, dest, pts.Key()); err != nil {
+					continue
+				}
+			}
+			if dest != maddr {
+				continue
+			}
+			if i >= len(rcpts) || rcpts[i].ExitCode.IsError() {
+				continue
+			}
+
+			sub := postSubmission{msg: m.Cid.String(), ts: pts}
+			if err := sub.params.UnmarshalCBOR(bytes.NewReader(m.Message.Params)); err != nil {
+				log.Warnw("decoding SubmitWindowedPoSt params", "message", m.Cid, "err", err)
+				continue
+			}
+			found = append(found, sub)
+		}
+
+		// walking backwards, so prepend
+		subs = append(found, subs...)
+		ts = pts
+	}
+
+	return subs, nil
+}
+
+// auditSubmission rebuilds the challenged sectors and the randomness of the
+// submission the way the miner actor does, and verifies the proof. The
+// partitions are read from the state the message was applied to; a message
+// earlier in the same tipset changing them is not accounted for.
+func auditSubmission(ctx context.Context, nodeApi api.FullNode, maddr addr.Address, sub postSubmission) postAudit {
+	a := postAudit{
+		Miner:    maddr.String(),
+		Message:  sub.msg,
+		Height:   sub.ts.Height(),
+		Deadline: sub.params.Deadline,
+		Status:   auditError,
+	}
+	for _, p := range sub.params.Partitions {
+		a.Partitions = append(a.Partitions, p.Index)
+	}
+	proofs := make([][]byte, 0, len(sub.params.Proofs))
+	for _, p := range sub.params.Proofs {
+		proofs = append(proofs, p.ProofBytes)
+	}
+	a.proofs = postKey(proofs...)
+
+	fail := func(err error) postAudit {
+		a.Error = err.Error()
+		return a
+	}
+
+	di, err := nodeApi.StateMinerProvingDeadline(ctx, maddr, sub.ts.Key())
+	if err != nil {
+		return fail(xerrors.Errorf("getting proving deadline: %w", err))
+	}
+	a.Open = di.Open
+	// proofs can be disputed for two finalities after the deadline closes
+	a.DisputableUntil = di.Close + 2*policy.ChainFinality
+
+	sInfo, err := challengedSectors(ctx, nodeApi, maddr, sub)
+	if err != nil {
+		return fail(err)
+	}
+	a.Sectors = len(sInfo)
+	if len(sInfo) == 0 {
+		a.Status = auditValid
+		return a
+	}
+
+	buf := new(bytes.Buffer)
+	if err := maddr.MarshalCBOR(buf); err != nil {
+		return fail(err)
+	}
+	rand, err := nodeApi.StateGetRandomnessFromBeacon(ctx, crypto.DomainSeparationTag_WindowedPoStChallengeSeed, di.Challenge, buf.Bytes(), sub.ts.Key())
+	if err != nil {
+		return fail(xerrors.Errorf("getting challenge randomness: %w", err))
+	}
+
+	mid, err := addr.IDFromAddress(maddr)
+	if err != nil {
+		return fail(err)
+	}
+
+	ok, err := ffiwrapper.ProofVerifier.VerifyWindowPoSt(ctx, proof.WindowPoStVerifyInfo{
+		Randomness:        abi.PoStRandomness(rand),
+		Proofs:            sub.params.Proofs,
+		ChallengedSectors: sInfo,
+		Prover:            abi.ActorID(mid),
+	})
+	if err != nil {
+		return fail(xerrors.Errorf("verifying proof: %w", err))
+	}
+
+	if ok {
+		a.Status = auditValid
+	} else {
+		a.Status = auditInvalid
+	}
+	return a
+}
+
+// challengedSectors returns the sectors the proof of the submission covers:
+// all sectors of its partitions in order, with terminated and faulty sectors
+// (including those skipped by the message, but not declared recoveries)
+// replaced by the first sector which is proven.
+func challengedSectors(ctx context.Context, nodeApi api.FullNode, maddr addr.Address, sub postSubmission) ([]proof.SectorInfo, error) {
+	parts, err := nodeApi.StateMinerPartitions(ctx, maddr, sub.params.Deadline, sub.ts.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("getting partitions of deadline %d: %w", sub.params.Deadline, err)
+	}
+
+	var all, ignored []bitfield.BitField
+	for _, pp := range sub.params.Partitions {
+		if pp.Index >= uint64(len(parts)) {
+			return nil, xerrors.Errorf("partition %d not found in deadline %d", pp.Index, sub.params.Deadline)
+		}
+		part := parts[pp.Index]
+
+		terminated, err := bitfield.SubtractBitField(part.AllSectors, part.LiveSectors)
+		if err != nil {
+			return nil, err
+		}
+		faulty, err := bitfield.SubtractBitField(part.FaultySectors, part.RecoveringSectors)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, part.AllSectors)
+		ignored = append(ignored, terminated, faulty, pp.Skipped)
+	}
+
+	allSectors, err := bitfield.MultiMerge(all...)
+	if err != nil {
+		return nil, err
+	}
+	ignoredSectors, err := bitfield.MultiMerge(ignored...)
+	if err != nil {
+		return nil, err
+	}
+
+	proven, err := bitfield.SubtractBitField(allSectors, ignoredSectors)
+	if err != nil {
+		return nil, err
+	}
+	if empty, err := proven.IsEmpty(); err != nil {
+		return nil, err
+	} else if empty {
+		// every sector was skipped or faulty, no proof is checked
+		return nil, nil
+	}
+
+	first, err := proven.First()
+	if err != nil {
+		return nil, err
+	}
+
+	ss, err := nodeApi.StateMinerSectors(ctx, maddr, &proven, sub.ts.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("getting sector infos: %w", err)
+	}
+
+	byNumber := make(map[abi.SectorNumber]proof.SectorInfo, len(ss))
+	for _, s := range ss {
+		byNumber[s.SectorNumber] = proof.SectorInfo{
+			SealProof:    s.SealProof,
+			SectorNumber: s.SectorNumber,
+			SealedCID:    s.SealedCID,
+		}
+	}
+
+	substitute, ok := byNumber[abi.SectorNumber(first)]
+	if !ok {
+		return nil, xerrors.Errorf("sector %d not found on chain", first)
+	}
+
+	var out []proof.SectorInfo
+	err = allSectors.ForEach(func(sectorNo uint64) error {
+		if info, ok := byNumber[abi.SectorNumber(sectorNo)]; ok {
+			out = append(out, info)
+		} else {
+			out = append(out, substitute)
+		}
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+)
+
+var batchFlag = &cli.BoolFlag{
+	Name:  "batch",
+	Usage: "group partitions into one proof per SubmitWindowedPoSt message like the miner does, instead of one proof per partition",
+}
+
+// emulateBatches simulates the WindowPoSt of the deadline the way the miner
+// submits it: the partitions, whose sectors are given by index in sets, are
+// split in index order into batches of partitionsPerMessage, and one proof is
+// generated over the sectors of all partitions of a batch. Partitions without
+// sectors to prove still take their place in a batch. The partition record of
+// a batch carries the index of its first partition and lists all of them in
+// Batch.
+func emulateBatches(src sectorSource, p *util.Provider, sets []bitfield.BitField, deadlineID int, set string, rep *report) error {
+	maddr := src.actor()
+
+	perMsg, err := src.partitionsPerMessage()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(sets); start += perMsg {
+		end := start + perMsg
+		if end > len(sets) {
+			end = len(sets)
+		}
+
+		batch := make([]int, 0, end-start)
+		for idx := start; idx < end; idx++ {
+			batch = append(batch, idx)
+		}
+
+		sectors, err := bitfield.MultiMerge(sets[start:end]...)
+		if err != nil {
+			return err
+		}
+
+		if empty, err := sectors.IsEmpty(); err != nil {
+			return err
+		} else if empty {
+			log.Infow("no sectors to simulate in the batch", "miner", maddr, "deadlineID", deadlineID, "partitions", batch, "set", set)
+			continue
+		}
+
+		pi, si := len(rep.Partitions), len(rep.Sectors)
+		log.Infow("simulating batch", "miner", maddr, "deadlineID", deadlineID, "partitions", batch)
+		if err := emulateSectors(src, p, deadlineID, batch[0], sectors, nil, rep); err != nil {
+			return err
+		}
+
+		rep.Partitions[pi].Batch = batch
+
+		// put each sector back into its own partition
+		for i := si; i < len(rep.Sectors); i++ {
+			for j, s := range sets[start:end] {
+				if ok, err := s.IsSet(rep.Sectors[i].Sector); err != nil {
+					return err
+				} else if ok {
+					rep.Sectors[i].Partition = batch[j]
+					break
+				}
+			}
+		}
+
+		pr := rep.Partitions[pi]
+		if pr.Status != statusOK {
+			log.Warnw("wdpost emulator err", "miner", maddr, "deadlineID", deadlineID, "partitions", batch, "status", pr.Status, "err", pr.Error)
+			continue
+		}
+
+		log.Infow("wdpost simulation of the batch is successful", "miner", maddr, "deadlineID", deadlineID, "partitions", batch, "sectors", pr.Sectors)
+	}
+
+	return nil
+}
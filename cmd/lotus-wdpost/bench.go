@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/ipfs/go-cid"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	benchOK    = "ok"
+	benchClose = "close"
+	benchOver  = "over"
+)
+
+type deadlineProjection struct {
+	Deadline   uint64 `json:"deadline"`
+	Partitions int    `json:"partitions"`
+	Messages   int    `json:"messages"`
+	// time to generate the proofs of all messages, one after another
+	ProjectedMs int64  `json:"projected_ms"`
+	BudgetMs    int64  `json:"budget_ms"`
+	Status      string `json:"status"`
+}
+
+type benchResult struct {
+	Miner             string               `json:"miner"`
+	Height            abi.ChainEpoch       `json:"height"`
+	Tipset            []cid.Cid            `json:"tipset"`
+	PartitionsPerMsg  int                  `json:"partitions_per_message"`
+	PerMessageMs      int64                `json:"per_message_ms"`
+	Samples           []partitionRecord    `json:"samples"`
+	DeadlineProjected []deadlineProjection `json:"deadlines"`
+}
+
+var benchCmd = &cli.Command{
+	Name:  "bench",
+	Usage: "time the WindowPost of sample partitions and project it for every deadline of the miner",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "deadline",
+			Usage: "take the sample partitions from this deadline, by default the deadline with the most partitions",
+			Value: -1,
+		},
+		&cli.IntFlag{
+			Name:  "samples",
+			Usage: "number of messages to time, each proving up to the partitions per message of the miner",
+			Value: 1,
+		},
+		&cli.Float64Flag{
+			Name:  "warn",
+			Usage: "flag deadlines whose projected time is above this fraction of the challenge window",
+			Value: 0.8,
+		},
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		sectorSetFlag,
+		util.TipSetFlag,
+		util.HeightFlag,
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: json or table",
+			Value: "table",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		output := cctx.String("output")
+		if output != "json" && output != "table" {
+			return xerrors.Errorf("unknown --output format: %s", output)
+		}
+		if err := checkSectorSet(cctx); err != nil {
+			return err
+		}
+		if cctx.Int("samples") < 1 {
+			return xerrors.New("--samples must be at least 1")
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(lcli.ReqContext(cctx), cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		p := util.NewProviderFromPaths(paths).UseChain(nodeApi, ts.Key())
+
+		// one document or set of tables per actor
+		for _, maddr := range maddrs {
+			res, err := benchDeadlines(nodeApi, ts, p, maddr, cctx.Int("deadline"), cctx.Int("samples"), cctx.String("set"), cctx.Float64("warn"))
+			if err != nil {
+				return xerrors.Errorf("miner %s: %w", maddr, err)
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(res); err != nil {
+					return err
+				}
+				continue
+			}
+
+			fmt.Printf("miner %s at height %d, tipset %s\n", res.Miner, res.Height, ts.Key())
+
+			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "DEADLINE\tPARTITIONS\tSECTORS\tSTATUS\tACQUIRE\tGENERATE\tFIRST GENERATE\tVERIFY")
+			for _, p := range res.Samples {
+				_, _ = fmt.Fprintf(tw, "%d\t%v\t%d\t%s\t%s\t%s\t%s\t%s\n", p.Deadline, p.Batch, p.Sectors, p.Status,
+					time.Duration(p.AcquireMs)*time.Millisecond, time.Duration(p.GenerateMs)*time.Millisecond,
+					time.Duration(p.FirstGenerateMs)*time.Millisecond, time.Duration(p.VerifyMs)*time.Millisecond)
+			}
+			_, _ = fmt.Fprintln(tw)
+
+			_, _ = fmt.Fprintln(tw, "DEADLINE\tPARTITIONS\tMESSAGES\tPROJECTED\tBUDGET\tSTATUS")
+			for _, d := range res.DeadlineProjected {
+				_, _ = fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\n", d.Deadline, d.Partitions, d.Messages,
+					time.Duration(d.ProjectedMs)*time.Millisecond, time.Duration(d.BudgetMs)*time.Millisecond, d.Status)
+			}
+			_, _ = fmt.Fprintln(tw)
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+// benchDeadlines times the proofs of sample messages and projects the
+// average time per message onto the messages of every deadline. Like the
+// miner, the partitions of a deadline are proven in messages of up to
+// PartitionsPerMsg, one message after another. Only the first proof of a
+// message is timed, a proof generated again without faulty sectors is not
+// part of a healthy run. The chain state is read at ts.
+func benchDeadlines(nodeApi api.FullNode, ts *types.TipSet, p *util.Provider, maddr addr.Address, deadlineID, samples int, set string, warn float64) (*benchResult, error) {
+	perMsg, err := maxPartitionsPerMessage(nodeApi, maddr, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	mas, err := loadMinerState(nodeApi, maddr, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[uint64]int{}
+	err = mas.ForEachDeadline(func(dlIdx uint64, dl miner.Deadline) error {
+		return dl.ForEachPartition(func(uint64, miner.Partition) error {
+			counts[dlIdx]++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if deadlineID < 0 {
+		for dlIdx := uint64(0); dlIdx < miner.WPoStPeriodDeadlines; dlIdx++ {
+			if n := counts[dlIdx]; n > 0 && (deadlineID < 0 || n > counts[uint64(deadlineID)]) {
+				deadlineID = int(dlIdx)
+			}
+		}
+		if deadlineID < 0 {
+			return nil, xerrors.New("the miner has no partitions")
+		}
+	}
+
+	dl, err := mas.LoadDeadline(uint64(deadlineID))
+	if err != nil {
+		return nil, xerrors.Errorf("loading deadline %d: %w", deadlineID, err)
+	}
+
+	// the partitions of the first messages of the deadline
+	var sets []bitfield.BitField
+	err = dl.ForEachPartition(func(_ uint64, part miner.Partition) error {
+		if len(sets) >= samples*perMsg {
+			return nil
+		}
+
+		sectors, err := partitionSectors(part, set)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, sectors)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rep report
+	if err := emulateBatches(&chainSource{api: nodeApi, maddr: maddr, ts: ts}, p, sets, deadlineID, set, &rep); err != nil {
+		return nil, err
+	}
+
+	var total time.Duration
+	var timed int
+	for _, pr := range rep.Partitions {
+		if pr.Status == statusFailed {
+			log.Warnw("message failed, left out of the projection", "deadline", pr.Deadline, "partitions", pr.Batch, "error", pr.Error)
+			continue
+		}
+
+		// a message with fewer partitions is scaled up to a full one
+		total += time.Duration(pr.FirstGenerateMs) * time.Millisecond * time.Duration(perMsg) / time.Duration(len(pr.Batch))
+		timed++
+	}
+	if timed == 0 {
+		return nil, xerrors.Errorf("no message of deadline %d could be proven", deadlineID)
+	}
+	perMessage := total / time.Duration(timed)
+
+	di, err := nodeApi.StateMinerProvingDeadline(context.Background(), maddr, ts.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proving deadline: %w", err)
+	}
+	budget := time.Duration(di.WPoStChallengeWindow) * time.Duration(build.BlockDelaySecs) * time.Second
+
+	res := &benchResult{
+		Miner:            maddr.String(),
+		Height:           ts.Height(),
+		Tipset:           ts.Cids(),
+		PartitionsPerMsg: perMsg,
+		PerMessageMs:     perMessage.Milliseconds(),
+		Samples:          rep.Partitions,
+	}
+
+	for dlIdx := uint64(0); dlIdx < di.WPoStPeriodDeadlines; dlIdx++ {
+		n := counts[dlIdx]
+		if n == 0 {
+			continue
+		}
+
+		// the last message of the deadline counts as a full one
+		messages := (n + perMsg - 1) / perMsg
+		projected := time.Duration(messages) * perMessage
+		status := benchOK
+		switch {
+		case projected > budget:
+			status = benchOver
+		case float64(projected) > warn*float64(budget):
+			status = benchClose
+		}
+
+		if status != benchOK {
+			log.Warnw("deadline may not be proven in time", "deadline", dlIdx, "partitions", n, "messages", messages, "projected", projected, "budget", budget)
+		}
+
+		res.DeadlineProjected = append(res.DeadlineProjected, deadlineProjection{
+			Deadline:    dlIdx,
+			Partitions:  n,
+			Messages:    messages,
+			ProjectedMs: projected.Milliseconds(),
+			BudgetMs:    budget.Milliseconds(),
+			Status:      status,
+		})
+	}
+
+	return res, nil
+}
+
+// maxPartitionsPerMessage returns how many partitions the miner proves in one
+// SubmitWindowedPoSt message at the network version of tsk.
+func maxPartitionsPerMessage(nodeApi api.FullNode, maddr addr.Address, tsk types.TipSetKey) (int, error) {
+	ctx := context.Background()
+
+	mi, err := nodeApi.StateMinerInfo(ctx, maddr, tsk)
+	if err != nil {
+		return 0, xerrors.Errorf("getting miner info: %w", err)
+	}
+
+	nv, err := nodeApi.StateNetworkVersion(ctx, tsk)
+	if err != nil {
+		return 0, xerrors.Errorf("getting network version: %w", err)
+	}
+
+	perMsg, err := policy.GetMaxPoStPartitions(nv, mi.WindowPoStProofType)
+	if err != nil {
+		return 0, xerrors.Errorf("getting max post partitions: %w", err)
+	}
+
+	// the declarations of a message are capped as well
+	if declMax := policy.GetDeclarationsMax(nv); perMsg > declMax {
+		perMsg = declMax
+	}
+
+	return perMsg, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var cacheCheckCmd = &cli.Command{
+	Name:  "cache-check",
+	Usage: "check the cache directory and sealed file of sectors without generating a proof",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sids",
+			Usage: "check only these sector ids, separate commas. ps: 1,2. With several actors, prefix each id with its actor. ps: f01234:1. By default all sectors of the actors in the storage paths are checked",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: json or table",
+			Value: "table",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		output := cctx.String("output")
+		if output != "json" && output != "table" {
+			return xerrors.Errorf("unknown --output format: %s", output)
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(lcli.ReqContext(cctx), cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		// one index of the storage paths for all actors
+		idx, err := util.NewProviderFromPaths(paths).Index()
+		if err != nil {
+			return err
+		}
+
+		var sids map[addr.Address]bitfield.BitField
+		if sidsStr := cctx.String("sids"); sidsStr != "" {
+			if sids, err = parseActorSectors(sidsStr, maddrs); err != nil {
+				return err
+			}
+		}
+
+		actors := map[abi.ActorID]addr.Address{}
+		for _, maddr := range maddrs {
+			mid, err := addr.IDFromAddress(maddr)
+			if err != nil {
+				return err
+			}
+			actors[abi.ActorID(mid)] = maddr
+		}
+
+		sectors := map[addr.Address][]abi.SectorID{}
+		if sids != nil {
+			for maddr, sbit := range sids {
+				mid, _ := addr.IDFromAddress(maddr)
+				err := sbit.ForEach(func(sid uint64) error {
+					sectors[maddr] = append(sectors[maddr], abi.SectorID{Miner: abi.ActorID(mid), Number: abi.SectorNumber(sid)})
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, sid := range idx.Sectors() {
+				if maddr, ok := actors[sid.Miner]; ok {
+					sectors[maddr] = append(sectors[maddr], sid)
+				}
+			}
+		}
+
+		infos := map[abi.SectorID]*miner.SectorOnChainInfo{}
+		var checks []util.CacheCheck
+		for _, maddr := range maddrs {
+			if len(sectors[maddr]) == 0 {
+				continue
+			}
+
+			ssize, _, err := util.GetSectorSizeAt(context.Background(), nodeApi, maddr, ts.Key())
+			if err != nil {
+				return err
+			}
+
+			mas, err := loadMinerState(nodeApi, maddr, ts.Key())
+			if err != nil {
+				return err
+			}
+
+			updated := map[abi.SectorID]bool{}
+			for _, sid := range sectors[maddr] {
+				info, err := mas.GetSector(sid.Number)
+				if err != nil {
+					return xerrors.Errorf("getting sector %d of %s: %w", sid.Number, maddr, err)
+				}
+				infos[sid] = info
+				updated[sid] = info != nil && info.SectorKeyCID != nil
+			}
+
+			checks = append(checks, util.CheckCaches(idx, sectors[maddr], ssize, updated)...)
+		}
+
+		var bad int
+		for i := range checks {
+			c := &checks[i]
+			c.Height, c.Tipset = ts.Height(), ts.Cids()
+
+			info := infos[c.Sector]
+			if info == nil {
+				c.Issues = append(c.Issues, "not in the on-chain sectors array")
+			} else {
+				commR, err := commcid.CIDToReplicaCommitmentV1(info.SealedCID)
+				if err != nil {
+					return xerrors.Errorf("decoding sealed cid of sector %d: %w", c.Sector.Number, err)
+				}
+				c.CommR = hex.EncodeToString(commR)
+
+				// the cache of another replica has another comm_c or comm_r_last
+				if c.PAuxCommR != "" && c.PAuxCommR != c.CommR {
+					c.Issues = append(c.Issues, "comm_r of p_aux doesn't match the sealed cid on chain")
+				}
+			}
+
+			if len(c.Issues) != 0 {
+				bad++
+			}
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(checks); err != nil {
+				return err
+			}
+		} else {
+			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "SECTOR\tCACHE ROOT\tCOMM_R\tP_AUX COMM_R\tISSUES")
+			for _, c := range checks {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", storiface.SectorName(c.Sector), c.CacheRoot, c.CommR, c.PAuxCommR, strings.Join(c.Issues, "; "))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+		log.Infow("cache check finished", "sectors", len(checks), "with issues", bad)
+		return nil
+	},
+}
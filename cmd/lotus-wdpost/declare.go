@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	builtin2 "github.com/filecoin-project/specs-actors/v2/actors/builtin"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+var declareCmd = &cli.Command{
+	Name:      "declare",
+	Usage:     "build DeclareFaults or DeclareFaultsRecovered message from a json simulation report",
+	ArgsUsage: "[report.json]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor id",
+		},
+		&cli.BoolFlag{
+			Name:  "recovered",
+			Usage: "declare the faulty sectors which passed the simulation as recovered, instead of declaring failed sectors faulty",
+		},
+		&cli.BoolFlag{
+			Name:  "really-do-it",
+			Usage: "push the message to the mpool instead of printing it",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.New("expected the path of a json simulation report")
+		}
+
+		b, err := ioutil.ReadFile(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		var rep report
+		if err := json.Unmarshal(b, &rep); err != nil {
+			return xerrors.Errorf("decoding report: %w", err)
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ctx := lcli.ReqContext(cctx)
+
+		maddr, err := util.GetActorAddress(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(ctx, cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		recovered := cctx.Bool("recovered")
+		decls, err := buildDeclarations(ctx, nodeApi, maddr, &rep, recovered, ts.Key())
+		if err != nil {
+			return err
+		}
+
+		if len(decls) == 0 {
+			log.Info("nothing to declare")
+			return nil
+		}
+
+		var params interface{}
+		var method abi.MethodNum
+		var enc []byte
+		if recovered {
+			p := &miner.DeclareFaultsRecoveredParams{}
+			for _, d := range decls {
+				p.Recoveries = append(p.Recoveries, miner.RecoveryDeclaration{
+					Deadline:  d.Deadline,
+					Partition: d.Partition,
+					Sectors:   d.Sectors,
+				})
+			}
+
+			var aerr error
+			params, method = p, builtin2.MethodsMiner.DeclareFaultsRecovered
+			if enc, aerr = actors.SerializeParams(p); aerr != nil {
+				return xerrors.Errorf("could not serialize declare recoveries parameters: %w", aerr)
+			}
+		} else {
+			p := &miner.DeclareFaultsParams{Faults: decls}
+
+			var aerr error
+			params, method = p, builtin2.MethodsMiner.DeclareFaults
+			if enc, aerr = actors.SerializeParams(p); aerr != nil {
+				return xerrors.Errorf("could not serialize declare faults parameters: %w", aerr)
+			}
+		}
+
+		mi, err := nodeApi.StateMinerInfo(ctx, maddr, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("getting miner info: %w", err)
+		}
+
+		msg := &types.Message{
+			To:     maddr,
+			From:   mi.Worker,
+			Method: method,
+			Params: enc,
+			Value:  types.NewInt(0),
+		}
+
+		if !cctx.Bool("really-do-it") {
+			out, err := json.MarshalIndent(map[string]interface{}{
+				"message": msg,
+				"params":  params,
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			_, _ = fmt.Fprintln(os.Stderr, "review the message above and pass --really-do-it to push it")
+			return nil
+		}
+
+		sm, err := nodeApi.MpoolPushMessage(ctx, msg, nil)
+		if err != nil {
+			return xerrors.Errorf("pushing message: %w", err)
+		}
+
+		log.Infow("declaration message pushed", "cid", sm.Cid(), "method", method)
+		return nil
+	},
+}
+
+// buildDeclarations groups the sectors of the report by deadline and
+// partition. Sectors are only kept if the declaration changes their on-chain
+// state, and deadlines whose fault cutoff has passed are left out. The chain
+// state is read at tsk.
+func buildDeclarations(ctx context.Context, nodeApi api.FullNode, maddr addr.Address, rep *report, recovered bool, tsk types.TipSetKey) ([]miner.FaultDeclaration, error) {
+	type partKey struct{ dl, part uint64 }
+	grouped := map[partKey]bitfield.BitField{}
+
+	for _, s := range rep.Sectors {
+		if s.Miner != maddr.String() {
+			continue
+		}
+
+		if recovered && s.Status != statusOK {
+			continue
+		}
+		if !recovered && s.Status != statusFaulty && s.Status != statusSkipped {
+			continue
+		}
+
+		key := partKey{dl: uint64(s.Deadline), part: uint64(s.Partition)}
+		if s.Deadline < 0 || s.Partition < 0 {
+			loc, err := nodeApi.StateSectorPartition(ctx, maddr, abi.SectorNumber(s.Sector), tsk)
+			if err != nil {
+				return nil, xerrors.Errorf("getting location of sector %d: %w", s.Sector, err)
+			}
+			if loc == nil {
+				return nil, xerrors.Errorf("sector %d is not in any partition", s.Sector)
+			}
+			key = partKey{dl: loc.Deadline, part: loc.Partition}
+		}
+
+		bf, ok := grouped[key]
+		if !ok {
+			bf = bitfield.New()
+		}
+		bf.Set(s.Sector)
+		grouped[key] = bf
+	}
+
+	di, err := nodeApi.StateMinerProvingDeadline(ctx, maddr, tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("getting proving deadline: %w", err)
+	}
+
+	partitions := map[uint64][]api.Partition{}
+
+	var decls []miner.FaultDeclaration
+	for key, sectors := range grouped {
+		dlInfo := dline.NewInfo(di.PeriodStart, key.dl, di.CurrentEpoch, di.WPoStPeriodDeadlines, di.WPoStProvingPeriod,
+			di.WPoStChallengeWindow, di.WPoStChallengeLookback, di.FaultDeclarationCutoff).NextNotElapsed()
+		if dlInfo.FaultCutoffPassed() {
+			log.Warnw("fault cutoff of the deadline has passed, declare again once it closes", "deadline", key.dl, "close", dlInfo.Close)
+			continue
+		}
+
+		parts, ok := partitions[key.dl]
+		if !ok {
+			parts, err = nodeApi.StateMinerPartitions(ctx, maddr, key.dl, tsk)
+			if err != nil {
+				return nil, xerrors.Errorf("getting partitions of deadline %d: %w", key.dl, err)
+			}
+			partitions[key.dl] = parts
+		}
+
+		if key.part >= uint64(len(parts)) {
+			return nil, xerrors.Errorf("deadline %d has no partition %d", key.dl, key.part)
+		}
+		part := parts[key.part]
+
+		// faults can only be declared for live sectors which are not faulty yet,
+		// recoveries only for faulty sectors which are not recovering yet
+		var candidates bitfield.BitField
+		if recovered {
+			candidates, err = bitfield.SubtractBitField(part.FaultySectors, part.RecoveringSectors)
+		} else {
+			candidates, err = bitfield.SubtractBitField(part.LiveSectors, part.FaultySectors)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		declared, err := bitfield.IntersectBitField(sectors, candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		if n, err := declared.Count(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			continue
+		}
+
+		decls = append(decls, miner.FaultDeclaration{
+			Deadline:  key.dl,
+			Partition: key.part,
+			Sectors:   declared,
+		})
+	}
+
+	sort.Slice(decls, func(i, j int) bool {
+		if decls[i].Deadline != decls[j].Deadline {
+			return decls[i].Deadline < decls[j].Deadline
+		}
+		return decls[i].Partition < decls[j].Partition
+	})
+
+	return decls, nil
+}
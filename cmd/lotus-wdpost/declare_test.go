@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"reflect"
+	"testing"
+)
+
+// declareNode answers the state reads of buildDeclarations.
+type declareNode struct {
+	api.FullNode
+
+	di    *dline.Info
+	parts map[uint64][]api.Partition
+	locs  map[abi.SectorNumber]*miner.SectorLocation
+}
+
+func (n *declareNode) StateMinerProvingDeadline(context.Context, addr.Address, types.TipSetKey) (*dline.Info, error) {
+	return n.di, nil
+}
+
+func (n *declareNode) StateMinerPartitions(_ context.Context, _ addr.Address, dlIdx uint64, _ types.TipSetKey) ([]api.Partition, error) {
+	return n.parts[dlIdx], nil
+}
+
+func (n *declareNode) StateSectorPartition(_ context.Context, _ addr.Address, sector abi.SectorNumber, _ types.TipSetKey) (*miner.SectorLocation, error) {
+	return n.locs[sector], nil
+}
+
+func TestBuildDeclarations(t *testing.T) {
+	maddr, err := addr.NewFromString("f01234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf := func(sectors ...uint64) bitfield.BitField {
+		return bitfield.NewFromSet(sectors)
+	}
+
+	node := &declareNode{
+		// at epoch 0 the fault cutoff of deadline 0 has passed, the one of
+		// deadline 5, which opens at 300, hasn't
+		di: dline.NewInfo(0, 0, 0, 48, 2880, 60, 20, 70),
+		parts: map[uint64][]api.Partition{
+			0: {{LiveSectors: bf(10)}},
+			5: {
+				{LiveSectors: bf(1, 2, 3, 4, 5), FaultySectors: bf(3, 4, 5), RecoveringSectors: bf(4)},
+				{LiveSectors: bf(20)},
+			},
+		},
+		locs: map[abi.SectorNumber]*miner.SectorLocation{
+			20: {Deadline: 5, Partition: 1},
+		},
+	}
+
+	rep := &report{Sectors: []sectorRecord{
+		{Miner: "f01234", Deadline: 5, Partition: 0, Sector: 1, Status: statusOK},
+		{Miner: "f01234", Deadline: 5, Partition: 0, Sector: 2, Status: statusFaulty},
+		{Miner: "f01234", Deadline: 5, Partition: 0, Sector: 3, Status: statusFaulty},
+		{Miner: "f01234", Deadline: 5, Partition: 0, Sector: 4, Status: statusOK},
+		{Miner: "f01234", Deadline: 5, Partition: 0, Sector: 5, Status: statusOK},
+		{Miner: "f01234", Deadline: 0, Partition: 0, Sector: 10, Status: statusSkipped},
+		// reports of s-emulator don't know the partition
+		{Miner: "f01234", Deadline: -1, Partition: -1, Sector: 20, Status: statusSkipped},
+		{Miner: "f05678", Deadline: 5, Partition: 0, Sector: 1, Status: statusFaulty},
+	}}
+
+	type decl struct {
+		Deadline, Partition uint64
+		Sectors             []uint64
+	}
+
+	tests := []struct {
+		name      string
+		recovered bool
+		want      []decl
+	}{
+		// 3 is faulty already, 10 is past the fault cutoff
+		{name: "faults", want: []decl{{5, 0, []uint64{2}}, {5, 1, []uint64{20}}}},
+		// 1 isn't faulty, 4 is recovering already
+		{name: "recoveries", recovered: true, want: []decl{{5, 0, []uint64{5}}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			decls, err := buildDeclarations(context.Background(), node, maddr, rep, tc.recovered, types.EmptyTSK)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []decl
+			for _, d := range decls {
+				sectors, err := d.Sectors.All(1 << 20)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, decl{d.Deadline, d.Partition, sectors})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildDeclarationsUnknownPartition(t *testing.T) {
+	maddr, err := addr.NewFromString("f01234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &declareNode{
+		di:    dline.NewInfo(0, 0, 0, 48, 2880, 60, 20, 70),
+		parts: map[uint64][]api.Partition{5: {{LiveSectors: bitfield.NewFromSet([]uint64{1})}}},
+	}
+	rep := &report{Sectors: []sectorRecord{
+		{Miner: "f01234", Deadline: 5, Partition: 3, Sector: 1, Status: statusFaulty},
+	}}
+
+	if _, err := buildDeclarations(context.Background(), node, maddr, rep, false, types.EmptyTSK); err == nil {
+		t.Fatal("expected an error for a partition the deadline doesn't have")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	builtin3 "github.com/filecoin-project/specs-actors/v3/actors/builtin"
+	miner3 "github.com/filecoin-project/specs-actors/v3/actors/builtin/miner"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"strings"
+	"time"
+)
+
+var disputerCmd = &cli.Command{
+	Name:  "disputer",
+	Usage: "verify the WindowPoSts of miners as they are accepted and dispute invalid ones",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "actors",
+			Usage: "miners to watch, separate commas. ps: f01234,f05678",
+		},
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "wallet address sending the disputes, by default the default wallet of the node",
+		},
+		&cli.BoolFlag{
+			Name:  "really-do-it",
+			Usage: "push the dispute messages instead of printing them",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.String("actors") == "" {
+			return xerrors.New("--actors is required")
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ctx := lcli.ReqContext(cctx)
+
+		head, err := nodeApi.ChainHead(ctx)
+		if err != nil {
+			return err
+		}
+
+		d := &disputer{
+			api:    nodeApi,
+			push:   cctx.Bool("really-do-it"),
+			miners: map[addr.Address]*disputedMiner{},
+		}
+
+		for _, s := range strings.Split(cctx.String("actors"), ",") {
+			maddr, err := addr.NewFromString(strings.TrimSpace(s))
+			if err != nil {
+				return xerrors.Errorf("parsing actor %s: %w", s, err)
+			}
+			if maddr, err = nodeApi.StateLookupID(ctx, maddr, head.Key()); err != nil {
+				return xerrors.Errorf("looking up miner id of %s: %w", s, err)
+			}
+			d.miners[maddr] = &disputedMiner{}
+		}
+
+		if from := cctx.String("from"); from != "" {
+			if d.from, err = addr.NewFromString(from); err != nil {
+				return err
+			}
+		} else if d.from, err = nodeApi.WalletDefaultAddress(ctx); err != nil {
+			return xerrors.Errorf("getting default wallet address: %w", err)
+		}
+
+		return d.run(ctx)
+	},
+}
+
+// postWindow is one proving window of a deadline.
+type postWindow struct {
+	deadline uint64
+	open     abi.ChainEpoch
+}
+
+type disputedMiner struct {
+	// epoch up to which the messages have been scanned
+	scanned abi.ChainEpoch
+	// invalid proofs waiting for their deadline to close
+	pending []postAudit
+}
+
+type disputer struct {
+	api    api.FullNode
+	from   addr.Address
+	push   bool
+	miners map[addr.Address]*disputedMiner
+}
+
+func (d *disputer) run(ctx context.Context) error {
+	log.Infow("disputer started", "miners", len(d.miners), "from", d.from, "push", d.push)
+
+	tick := time.NewTicker(time.Duration(build.BlockDelaySecs) * time.Second)
+	defer tick.Stop()
+
+	for {
+		head, err := d.api.ChainHead(ctx)
+		if err != nil {
+			log.Errorw("getting chain head", "err", err)
+		} else {
+			for maddr, m := range d.miners {
+				if err := d.check(ctx, head, maddr, m); err != nil {
+					log.Errorw("disputer check failed", "miner", maddr, "err", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// check verifies the submissions of the miner accepted since the last check,
+// and disputes the invalid ones once their deadline has closed. On the first
+// check, the submissions still inside the dispute window are verified.
+func (d *disputer) check(ctx context.Context, head *types.TipSet, maddr addr.Address, m *disputedMiner) error {
+	// proofs can be disputed for two finalities after their deadline closes
+	disputeWindow := 2 * policy.ChainFinality
+
+	from := m.scanned + 1
+	if m.scanned == 0 {
+		from = head.Height() - disputeWindow - policy.GetWPoStChallengeWindow()
+	}
+
+	if from < head.Height() {
+		subs, err := findPoStSubmissions(ctx, d.api, maddr, from, head.Height()-1, head)
+		if err != nil {
+			return err
+		}
+		m.scanned = head.Height() - 1
+
+		for _, sub := range subs {
+			a := auditSubmission(ctx, d.api, maddr, sub)
+
+			switch a.Status {
+			case auditValid:
+				log.Debugw("proof is valid", "miner", maddr, "message", a.Message, "deadline", a.Deadline)
+			case auditInvalid:
+				log.Warnw("invalid proof found", "miner", maddr, "message", a.Message, "deadline", a.Deadline, "disputable until", a.DisputableUntil)
+				m.pending = append(m.pending, a)
+			default:
+				log.Errorw("proof could not be verified", "miner", maddr, "message", a.Message, "err", a.Error)
+			}
+		}
+	}
+
+	var keep []postAudit
+	for _, a := range m.pending {
+		switch {
+		case head.Height() > a.DisputableUntil:
+			log.Warnw("dispute window passed", "miner", maddr, "message", a.Message)
+		case head.Height() < a.Open+policy.GetWPoStChallengeWindow():
+			// the deadline is still open
+			keep = append(keep, a)
+		default:
+			if err := d.dispute(ctx, head, maddr, a); err != nil {
+				log.Errorw("disputing proof", "miner", maddr, "message", a.Message, "err", err)
+				keep = append(keep, a)
+			}
+		}
+	}
+	m.pending = keep
+
+	return nil
+}
+
+// dispute finds the proof in the OptimisticPoStSubmissionsSnapshot of its
+// closed deadline, builds the DisputeWindowedPoSt message with its index
+// there and checks with StateCall that the actor accepts it, before printing
+// or pushing it.
+func (d *disputer) dispute(ctx context.Context, head *types.TipSet, maddr addr.Address, a postAudit) error {
+	idx, err := postIndexes(ctx, d.api, maddr, postWindow{deadline: a.Deadline, open: a.Open}, head)
+	if err != nil {
+		return xerrors.Errorf("reading the recorded proofs of deadline %d: %w", a.Deadline, err)
+	}
+	i, ok := idx[a.proofs]
+	if !ok {
+		// proofs which recovered sectors are verified on chain
+		log.Warnw("the deadline didn't record the proof, it can't be disputed", "miner", maddr, "message", a.Message, "deadline", a.Deadline)
+		return nil
+	}
+
+	params := &miner3.DisputeWindowedPoStParams{
+		Deadline:  a.Deadline,
+		PoStIndex: i,
+	}
+	enc, aerr := actors.SerializeParams(params)
+	if aerr != nil {
+		return xerrors.Errorf("could not serialize dispute parameters: %w", aerr)
+	}
+
+	msg := &types.Message{
+		To:     maddr,
+		From:   d.from,
+		Method: builtin3.MethodsMiner.DisputeWindowedPoSt,
+		Params: enc,
+		Value:  types.NewInt(0),
+	}
+
+	res, err := d.api.StateCall(ctx, msg, head.Key())
+	if err != nil {
+		return xerrors.Errorf("simulating dispute: %w", err)
+	}
+	if res.MsgRct.ExitCode.IsError() {
+		// the local verifier and the actor disagree, don't spend gas on it
+		log.Warnw("the actor would reject the dispute, dropping it", "miner", maddr, "deadline", a.Deadline, "post index", i,
+			"exit code", res.MsgRct.ExitCode, "err", res.Error)
+		return nil
+	}
+
+	if !d.push {
+		out, err := json.MarshalIndent(map[string]interface{}{
+			"message": msg,
+			"params":  params,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		log.Infow("dispute message prepared, pass --really-do-it to push it", "miner", maddr, "deadline", a.Deadline, "post index", i)
+		return nil
+	}
+
+	sm, err := d.api.MpoolPushMessage(ctx, msg, nil)
+	if err != nil {
+		return xerrors.Errorf("pushing message: %w", err)
+	}
+
+	log.Infow("dispute message pushed", "cid", sm.Cid(), "miner", maddr, "deadline", a.Deadline, "post index", i)
+	return nil
+}
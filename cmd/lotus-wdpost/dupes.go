@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"text/tabwriter"
+)
+
+var dupesCmd = &cli.Command{
+	Name:  "dupes",
+	Usage: "list sectors with more than one copy, or with sealed and cache files in different storage paths",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: json or table",
+			Value: "table",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		output := cctx.String("output")
+		if output != "json" && output != "table" {
+			return xerrors.Errorf("unknown --output format: %s", output)
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		idx, err := util.NewProviderFromPaths(paths).Index()
+		if err != nil {
+			return err
+		}
+
+		dupes, err := util.FindDuplicates(idx)
+		if err != nil {
+			return err
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(dupes)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "SECTOR\tTYPE\tROOT\tSIZE\tP_AUX")
+		for _, d := range dupes {
+			for _, c := range d.Copies {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", storiface.SectorName(d.Sector), c.Type, c.Root, c.Size, c.PAux)
+			}
+			_, _ = fmt.Fprintf(tw, "%s\tkeep\t%s\t\t%s\n", storiface.SectorName(d.Sector), d.Keep, d.Reason)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		log.Infow("duplicate scan finished", "sectors", len(idx.Sectors()), "duplicates", len(dupes))
+		return nil
+	},
+}
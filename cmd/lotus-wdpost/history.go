@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/filecoin-project/go-state-types/abi"
+	lcli "github.com/filecoin-project/lotus/cli"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var historyRepoFlag = &cli.StringFlag{
+	Name:    "history-repo",
+	Usage:   "keep the simulation results of every run in a database in this directory, empty to disable",
+	EnvVars: []string{"LOTUS_WDPOST_PATH"},
+	Value:   "~/.lotus-wdpost",
+}
+
+// historyRecord is the result of one sector in one simulation run.
+type historyRecord struct {
+	Miner     string         `json:"miner"`
+	Sector    uint64         `json:"sector"`
+	Deadline  int            `json:"deadline"`
+	Partition int            `json:"partition"`
+	Status    string         `json:"status"`
+	SealedDir string         `json:"sealed_dir"`
+	CacheDir  string         `json:"cache_dir"`
+	Reason    string         `json:"reason,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ElapsedMs int64          `json:"elapsed_ms"`
+	Epoch     abi.ChainEpoch `json:"epoch"`
+	Time      time.Time      `json:"time"`
+}
+
+// sectorSummary sums up the history of a sector.
+type sectorSummary struct {
+	Miner  string        `json:"miner"`
+	Sector uint64        `json:"sector"`
+	Latest historyRecord `json:"latest"`
+	// last run in which the sector was proven
+	LastGood *historyRecord `json:"last_good,omitempty"`
+	// first failing run after LastGood, if the sector is failing now
+	BadSince *time.Time `json:"bad_since,omitempty"`
+	Checks   int        `json:"checks"`
+	// status changes between runs, a flapping sector has many
+	Changes int `json:"changes"`
+}
+
+// historyStore keeps the history records in a leveldb, under the key
+// /sectors/<miner>/<sector>/<unix nano>, so that the records of a sector
+// are listed in time order.
+type historyStore struct {
+	ds *leveldb.Datastore
+}
+
+// openHistory opens the database in the repo. Only one process can have it
+// open, so it is not kept open between runs.
+func openHistory(repo string) (*historyStore, error) {
+	repo, err := homedir.Expand(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		return nil, xerrors.Errorf("creating history repo: %w", err)
+	}
+
+	d, err := leveldb.NewDatastore(filepath.Join(repo, "history"), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("opening history in %s: %w", repo, err)
+	}
+
+	return &historyStore{ds: d}, nil
+}
+
+func (h *historyStore) Close() error {
+	return h.ds.Close()
+}
+
+func historyKey(miner string, sector uint64, t time.Time) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/sectors/%s/%d/%020d", miner, sector, t.UnixNano()))
+}
+
+// record stores the sector results of the report, all at time t. Sectors of
+// a failed partition get the error of the partition.
+func (h *historyStore) record(ctx context.Context, rep *report, t time.Time) error {
+	type partKey struct {
+		miner               string
+		deadline, partition int
+	}
+	errs := map[partKey]string{}
+	for _, pr := range rep.Partitions {
+		parts := pr.Batch
+		if len(parts) == 0 {
+			parts = []int{pr.Partition}
+		}
+		for _, idx := range parts {
+			errs[partKey{pr.Miner, pr.Deadline, idx}] = pr.Error
+		}
+	}
+
+	b, err := h.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range rep.Sectors {
+		rec := historyRecord{
+			Miner:     s.Miner,
+			Sector:    s.Sector,
+			Deadline:  s.Deadline,
+			Partition: s.Partition,
+			Status:    s.Status,
+			SealedDir: s.SealedDir,
+			CacheDir:  s.CacheDir,
+			Reason:    s.Reason,
+			ElapsedMs: s.ElapsedMs,
+			Epoch:     rep.epoch(s.Miner),
+			Time:      t,
+		}
+		if s.Status != statusOK {
+			rec.Error = errs[partKey{s.Miner, s.Deadline, s.Partition}]
+		}
+
+		val, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(ctx, historyKey(s.Miner, s.Sector, t), val); err != nil {
+			return err
+		}
+	}
+
+	return b.Commit(ctx)
+}
+
+// forEachSector calls cb with the records of each sector under the prefix,
+// in time order.
+func (h *historyStore) forEachSector(ctx context.Context, prefix string, cb func([]historyRecord) error) error {
+	res, err := h.ds.Query(ctx, query.Query{Prefix: prefix, Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return xerrors.Errorf("querying history: %w", err)
+	}
+	defer res.Close() //nolint:errcheck
+
+	var recs []historyRecord
+	for r := range res.Next() {
+		if r.Error != nil {
+			return xerrors.Errorf("reading history: %w", r.Error)
+		}
+
+		var rec historyRecord
+		if err := json.Unmarshal(r.Value, &rec); err != nil {
+			return xerrors.Errorf("decoding history record %s: %w", r.Key, err)
+		}
+
+		if len(recs) != 0 && (recs[0].Miner != rec.Miner || recs[0].Sector != rec.Sector) {
+			if err := cb(recs); err != nil {
+				return err
+			}
+			recs = nil
+		}
+		recs = append(recs, rec)
+	}
+
+	if len(recs) != 0 {
+		return cb(recs)
+	}
+	return nil
+}
+
+func summarize(recs []historyRecord) sectorSummary {
+	sum := sectorSummary{
+		Miner:  recs[0].Miner,
+		Sector: recs[0].Sector,
+		Latest: recs[len(recs)-1],
+		Checks: len(recs),
+	}
+
+	for i := range recs {
+		if i > 0 && recs[i].Status != recs[i-1].Status {
+			sum.Changes++
+		}
+
+		if recs[i].Status == statusOK {
+			sum.LastGood = &recs[i]
+			sum.BadSince = nil
+		} else if sum.BadSince == nil {
+			sum.BadSince = &recs[i].Time
+		}
+	}
+
+	return sum
+}
+
+// recordHistory stores the report in the repo. The simulation is done
+// already, so a failure is only logged.
+func recordHistory(ctx context.Context, repo string, rep *report) {
+	if repo == "" || len(rep.Sectors) == 0 {
+		return
+	}
+
+	h, err := openHistory(repo)
+	if err != nil {
+		log.Warnw("simulation results not kept in the history", "err", err)
+		return
+	}
+	defer h.Close() //nolint:errcheck
+
+	if err := h.record(ctx, rep, time.Now()); err != nil {
+		log.Warnw("simulation results not kept in the history", "err", err)
+	}
+}
+
+var historyCmd = &cli.Command{
+	Name:  "history",
+	Usage: "query the simulation results kept by earlier runs",
+	Subcommands: []*cli.Command{
+		historySectorCmd,
+		historyLastGoodCmd,
+		historyWentBadCmd,
+	},
+}
+
+var historyFlags = []cli.Flag{
+	historyRepoFlag,
+	&cli.StringFlag{
+		Name:  "actor",
+		Usage: "miner actor ids, if there are more than one, separate commas",
+	},
+	&cli.StringFlag{
+		Name:  "output",
+		Usage: "output format: json or table",
+		Value: "table",
+	},
+}
+
+var historySectorCmd = &cli.Command{
+	Name:      "sector",
+	Usage:     "list every result of a sector",
+	ArgsUsage: "<sector number>",
+	Flags:     historyFlags,
+	Action: func(cctx *cli.Context) error {
+		sid, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return xerrors.Errorf("expected a sector number: %w", err)
+		}
+
+		var recs []historyRecord
+		err = queryHistory(cctx, fmt.Sprintf("/%d", sid), func(r []historyRecord) error {
+			recs = append(recs, r...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if cctx.String("output") == "json" {
+			return printJSON(recs)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "MINER\tTIME\tEPOCH\tDEADLINE\tPARTITION\tSTATUS\tSEALED DIR\tCACHE DIR\tELAPSED\tERROR")
+		for _, r := range recs {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", r.Miner, r.Time.Format(time.RFC3339), r.Epoch, r.Deadline, r.Partition, r.Status,
+				r.SealedDir, r.CacheDir, time.Duration(r.ElapsedMs)*time.Millisecond, recordError(r))
+		}
+		return tw.Flush()
+	},
+}
+
+var historyLastGoodCmd = &cli.Command{
+	Name:  "last-good",
+	Usage: "show when each sector was last proven",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "sids",
+			Usage: "show only these sector ids, separate commas. ps: 1,2",
+		},
+	}, historyFlags...),
+	Action: func(cctx *cli.Context) error {
+		var only map[uint64]struct{}
+		if sidsStr := cctx.String("sids"); sidsStr != "" {
+			only = map[uint64]struct{}{}
+			for _, id := range strings.Split(sidsStr, ",") {
+				sid, err := strconv.ParseUint(id, 10, 64)
+				if err != nil {
+					log.Warnw("sector id parsing failed", "id", id)
+					continue
+				}
+				only[sid] = struct{}{}
+			}
+		}
+
+		var sums []sectorSummary
+		err := queryHistory(cctx, "", func(recs []historyRecord) error {
+			if _, ok := only[recs[0].Sector]; only == nil || ok {
+				sums = append(sums, summarize(recs))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return printSummaries(cctx, sums)
+	},
+}
+
+var historyWentBadCmd = &cli.Command{
+	Name:  "went-bad",
+	Usage: "list the sectors failing now which started failing since a given time",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "RFC3339 time, or a duration back from now. ps: 2022-03-01T00:00:00Z or 24h",
+			Value: "24h",
+		},
+	}, historyFlags...),
+	Action: func(cctx *cli.Context) error {
+		since, err := parseSince(cctx.String("since"))
+		if err != nil {
+			return err
+		}
+
+		var sums []sectorSummary
+		err = queryHistory(cctx, "", func(recs []historyRecord) error {
+			sum := summarize(recs)
+			if sum.BadSince != nil && !sum.BadSince.Before(since) {
+				sums = append(sums, sum)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return printSummaries(cctx, sums)
+	},
+}
+
+// queryHistory calls cb with the records of each sector of the actors, or of
+// the sector under each actor when sub is set.
+func queryHistory(cctx *cli.Context, sub string, cb func([]historyRecord) error) error {
+	if o := cctx.String("output"); o != "json" && o != "table" {
+		return xerrors.Errorf("unknown --output format: %s", o)
+	}
+
+	repo := cctx.String(historyRepoFlag.Name)
+	if repo == "" {
+		return xerrors.New("--history-repo is required")
+	}
+
+	maddrs, err := util.GetActorAddresses(cctx)
+	if err != nil {
+		return err
+	}
+
+	h, err := openHistory(repo)
+	if err != nil {
+		return err
+	}
+	defer h.Close() //nolint:errcheck
+
+	for _, maddr := range maddrs {
+		if err := h.forEachSector(lcli.ReqContext(cctx), "/sectors/"+maddr.String()+sub, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("--since is neither a duration nor an RFC3339 time: %s", s)
+	}
+	return t, nil
+}
+
+func recordError(r historyRecord) string {
+	if r.Error != "" {
+		return r.Error
+	}
+	return r.Reason
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printSummaries(cctx *cli.Context, sums []sectorSummary) error {
+	if cctx.String("output") == "json" {
+		return printJSON(sums)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "MINER\tSECTOR\tSTATUS\tLAST CHECK\tLAST GOOD\tLAST GOOD EPOCH\tLAST GOOD DIR\tBAD SINCE\tCHECKS\tCHANGES\tERROR")
+	for _, s := range sums {
+		lastGood, lastGoodEpoch, lastGoodDir := "never", "-", "-"
+		if s.LastGood != nil {
+			lastGood = s.LastGood.Time.Format(time.RFC3339)
+			lastGoodEpoch = strconv.FormatInt(int64(s.LastGood.Epoch), 10)
+			lastGoodDir = s.LastGood.SealedDir
+		}
+		badSince := "-"
+		if s.BadSince != nil {
+			badSince = s.BadSince.Format(time.RFC3339)
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", s.Miner, s.Sector, s.Latest.Status, s.Latest.Time.Format(time.RFC3339),
+			lastGood, lastGoodEpoch, lastGoodDir, badSince, s.Checks, s.Changes, recordError(s.Latest))
+	}
+	return tw.Flush()
+}
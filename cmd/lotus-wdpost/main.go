@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"fmt"
 	addr "github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-bitfield"
 	"github.com/filecoin-project/go-state-types/abi"
@@ -21,6 +22,7 @@ import (
 	"golang.org/x/xerrors"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var log = logging.Logger("wdpost")
@@ -37,6 +39,18 @@ func main() {
 			sectorEmulator,
 			partitionEmulator,
 			deadlineEmulator,
+			winningEmulator,
+			watchCmd,
+			declareCmd,
+			dupesCmd,
+			orphansCmd,
+			missingCmd,
+			exportCmd,
+			historyCmd,
+			cacheCheckCmd,
+			benchCmd,
+			auditCmd,
+			disputerCmd,
 		},
 	}
 
@@ -50,65 +64,102 @@ var sectorEmulator = &cli.Command{
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "sids",
-			Usage: "simulate sector ids, if there are more than one, separate commas. ps: 1,2",
+			Usage: "simulate sector ids, if there are more than one, separate commas. ps: 1,2. With several actors, prefix each id with its actor. ps: f01234:1,f05678:2",
 			Value: "",
 		}, &cli.StringFlag{
 			Name:  "sdir",
 			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
 			Value: "",
 		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
 		&cli.StringFlag{
 			Name:  "actor",
-			Usage: "miner actor id",
+			Usage: "miner actor ids, if there are more than one, separate commas",
 		},
+		&cli.BoolFlag{
+			Name:  "strict",
+			Usage: "fail if a sector is not live on chain instead of reporting it",
+		},
+		offlineFlag,
+		util.TipSetFlag,
+		util.HeightFlag,
+		historyRepoFlag,
+		outputFlag,
+		metricsPushFlag,
+		alertWebhookFlag,
+		alertExecFlag,
+		alertFileFlag,
+		alertStateFlag,
 	},
 	Action: func(cctx *cli.Context) error {
-		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err := checkOutputFormat(cctx); err != nil {
+			return err
+		}
+
+		srcs, closer, err := getSectorSources(cctx)
 		if err != nil {
 			return err
 		}
 		defer closer()
 
-		sidsStr := cctx.String("sids")
-		sids := strings.Split(sidsStr, ",")
-
-		sbit := bitfield.New()
-		for _, id := range sids {
-			sid, err := strconv.Atoi(id)
-			if err != nil {
-				log.Warnw("sector id parsing failed", "id", id)
-				continue
-			}
-			sbit.Set(uint64(sid))
+		var actors []addr.Address
+		for _, src := range srcs {
+			actors = append(actors, src.actor())
 		}
 
-		sdir, err := getSdir(cctx)
+		sids, err := parseActorSectors(cctx.String("sids"), actors)
 		if err != nil {
 			return err
 		}
 
-		maddr, err := util.GetActorAddress(cctx)
+		paths, err := getStoragePaths(cctx)
 		if err != nil {
 			return err
 		}
 
-		amid, err := addr.IDFromAddress(maddr)
-		if err != nil {
-			return err
-		}
+		// one index of the storage paths for all actors
+		p := util.NewProviderFromPaths(paths)
 
-		sInfo, err := getSectorInfo(nodeApi, maddr, sbit)
-		if err != nil {
-			return err
+		var rep report
+		for _, src := range srcs {
+			sbit, ok := sids[src.actor()]
+			if !ok {
+				continue
+			}
+
+			issues, err := src.explain(sbit)
+			if err != nil {
+				return err
+			}
+
+			if len(issues) != 0 {
+				for sid, reason := range issues {
+					log.Warnw("sector is not live on chain", "miner", src.actor(), "sid", sid, "reason", reason)
+				}
+				if cctx.Bool("strict") {
+					return xerrors.Errorf("%d sector(s) of %s are not live on chain", len(issues), src.actor())
+				}
+			}
+
+			epoch, tsk := src.tipset()
+			rep.addActor(src.actor(), epoch, tsk)
+
+			if err := emulateSectors(src, src.attach(p), -1, -1, sbit, issues, &rep); err != nil {
+				return err
+			}
 		}
 
-		err = wdpostEmulator(util.NewProvider(sdir), abi.ActorID(amid), sInfo)
-		if err != nil {
+		if err := finishReport(cctx, &rep); err != nil {
 			return err
 		}
 
-		sectorIds, _ := sbit.All(100000)
-		log.Infow("wdpost simulation is successful", "sids", sectorIds)
+		for _, src := range srcs {
+			if _, ok := sids[src.actor()]; ok {
+				log.Infow("wdpost simulation is successful", "miner", src.actor(), "sids", rep.okSectors(src.actor().String(), -1, -1))
+			}
+		}
 		return nil
 	},
 }
@@ -130,10 +181,24 @@ var partitionEmulator = &cli.Command{
 			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
 			Value: "",
 		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
 		&cli.StringFlag{
 			Name:  "actor",
-			Usage: "miner actor id",
+			Usage: "miner actor ids, if there are more than one, separate commas",
 		},
+		sectorSetFlag,
+		offlineFlag,
+		util.TipSetFlag,
+		util.HeightFlag,
+		historyRepoFlag,
+		outputFlag,
+		metricsPushFlag,
+		alertWebhookFlag,
+		alertExecFlag,
+		alertFileFlag,
+		alertStateFlag,
 	},
 	Action: func(cctx *cli.Context) error {
 		deadlineID := cctx.Int("deadline")
@@ -141,74 +206,69 @@ var partitionEmulator = &cli.Command{
 		if deadlineID < 0 || deadlineID > 47 {
 			return xerrors.New("--deadline must be between 0 and 47")
 		}
-
-		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
-		if err != nil {
+		if err := checkOutputFormat(cctx); err != nil {
 			return err
 		}
-		defer closer()
-
-		maddr, err := util.GetActorAddress(cctx)
-		if err != nil {
+		if err := checkSectorSet(cctx); err != nil {
 			return err
 		}
 
-		amid, err := addr.IDFromAddress(maddr)
+		srcs, closer, err := getSectorSources(cctx)
 		if err != nil {
 			return err
 		}
+		defer closer()
 
-		head, err := nodeApi.ChainHead(context.Background())
+		paths, err := getStoragePaths(cctx)
 		if err != nil {
 			return err
 		}
 
-		mact, err := nodeApi.StateGetActor(context.Background(), maddr, head.Key())
-		if err != nil {
-			return err
-		}
+		p := util.NewProviderFromPaths(paths)
 
-		tbs := blockstore.NewTieredBstore(blockstore.NewAPIBlockstore(nodeApi), blockstore.NewMemory())
-		mas, err := miner.Load(adt.WrapStore(context.Background(), cbor.NewCborStore(tbs)), mact)
-		if err != nil {
-			return err
-		}
+		var rep report
+		found := false
+		for _, src := range srcs {
+			parts, err := src.partitions(deadlineID, cctx.String("set"))
+			if err != nil {
+				return err
+			}
+			if partitionID < 0 || partitionID >= len(parts) {
+				log.Warnw("the deadline has no such partition", "miner", src.actor(), "deadlineID", deadlineID, "partitionID", partitionID)
+				continue
+			}
+			found = true
+			sectors := parts[partitionID]
 
-		dl, err := mas.LoadDeadline(uint64(deadlineID))
-		if err != nil {
-			return err
-		}
+			if empty, err := sectors.IsEmpty(); err != nil {
+				return err
+			} else if empty {
+				log.Infow("no sectors to simulate in the partition", "miner", src.actor(), "set", cctx.String("set"))
+				continue
+			}
 
-		part, err := dl.LoadPartition(uint64(partitionID))
-		if err != nil {
-			return err
-		}
+			epoch, tsk := src.tipset()
+			rep.addActor(src.actor(), epoch, tsk)
 
-		liveSector, err := part.LiveSectors()
-		if err != nil {
-			return err
+			if err := emulateSectors(src, src.attach(p), deadlineID, partitionID, sectors, nil, &rep); err != nil {
+				return err
+			}
 		}
-
-		sInfo, err := getSectorInfo(nodeApi, maddr, liveSector)
-		if err != nil {
-			return err
+		if !found {
+			return xerrors.Errorf("deadline %d of none of the actors has partition %d", deadlineID, partitionID)
 		}
 
-		sdir, err := getSdir(cctx)
-		if err != nil {
+		if err := finishReport(cctx, &rep); err != nil {
 			return err
 		}
 
-		err = wdpostEmulator(util.NewProvider(sdir), abi.ActorID(amid), sInfo)
-		if err != nil {
-			return err
+		for _, a := range rep.Actors {
+			log.Infow("wdpost simulation is successful", "miner", a.Miner, "sids", rep.okSectors(a.Miner, deadlineID, partitionID))
 		}
-
-		sids, _ := liveSector.All(1000000)
-		log.Infow("wdpost simulation is successful", "sids", sids)
 		return nil
 	},
 }
+
 var deadlineEmulator = &cli.Command{
 	Name:  "d-emulator",
 	Usage: "deadline WindowPost simulator",
@@ -222,103 +282,327 @@ var deadlineEmulator = &cli.Command{
 			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
 			Value: "",
 		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
 		&cli.StringFlag{
 			Name:  "actor",
-			Usage: "miner actor id",
+			Usage: "miner actor ids, if there are more than one, separate commas",
 		},
+		sectorSetFlag,
+		batchFlag,
+		parallelFlag,
+		memoryFlag,
+		partitionMemoryFlag,
+		offlineFlag,
+		util.TipSetFlag,
+		util.HeightFlag,
+		historyRepoFlag,
+		outputFlag,
+		metricsPushFlag,
+		alertWebhookFlag,
+		alertExecFlag,
+		alertFileFlag,
+		alertStateFlag,
 	},
 	Action: func(cctx *cli.Context) error {
 		deadlineID := cctx.Int("deadline")
 		if deadlineID < 0 || deadlineID > 47 {
 			return xerrors.New("--deadline must be between 0 and 47")
 		}
-
-		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
-		if err != nil {
+		if err := checkOutputFormat(cctx); err != nil {
 			return err
 		}
-		defer closer()
-
-		maddr, err := util.GetActorAddress(cctx)
-		if err != nil {
+		if err := checkSectorSet(cctx); err != nil {
 			return err
 		}
-
-		amid, err := addr.IDFromAddress(maddr)
+		lim, err := getPartitionLimits(cctx)
 		if err != nil {
 			return err
 		}
 
-		sdir, err := getSdir(cctx)
+		srcs, closer, err := getSectorSources(cctx)
 		if err != nil {
 			return err
 		}
+		defer closer()
 
-		head, err := nodeApi.ChainHead(context.Background())
+		paths, err := getStoragePaths(cctx)
 		if err != nil {
 			return err
 		}
 
-		mact, err := nodeApi.StateGetActor(context.Background(), maddr, head.Key())
-		if err != nil {
+		p := util.NewProviderFromPaths(paths)
+
+		var rep report
+		for _, src := range srcs {
+			epoch, tsk := src.tipset()
+			rep.addActor(src.actor(), epoch, tsk)
+
+			if err := emulateDeadline(src, src.attach(p), deadlineID, cctx.String("set"), cctx.Bool("batch"), lim, &rep); err != nil {
+				return err
+			}
+		}
+
+		return finishReport(cctx, &rep)
+	},
+}
+
+// loadMinerState loads the state of the miner actor at tsk, the chain head
+// if it is empty.
+func loadMinerState(nodeApi api.FullNode, maddr addr.Address, tsk types.TipSetKey) (miner.State, error) {
+	mact, err := nodeApi.StateGetActor(context.Background(), maddr, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs := blockstore.NewTieredBstore(blockstore.NewAPIBlockstore(nodeApi), blockstore.NewMemory())
+	return miner.Load(adt.WrapStore(context.Background(), cbor.NewCborStore(tbs)), mact)
+}
+
+// emulateDeadline simulates the WindowPoSt of every partition in the deadline
+// and adds the results to rep. A failing partition does not stop the others.
+// All partitions share the sector index of p. With batch, partitions are
+// proven together as the miner batches them, see emulateBatches. With lim,
+// several partitions are proven at once, see emulatePartitions.
+func emulateDeadline(src sectorSource, p *util.Provider, deadlineID int, set string, batch bool, lim *partitionLimits, rep *report) error {
+	maddr := src.actor()
+
+	parts, err := src.partitions(deadlineID, set)
+	if err != nil {
+		return err
+	}
+
+	if batch {
+		return emulateBatches(src, p, parts, deadlineID, set, rep)
+	}
+
+	if lim != nil {
+		return emulatePartitions(src, p, parts, deadlineID, set, lim, rep)
+	}
+
+	for idx, sectors := range parts {
+		if empty, err := sectors.IsEmpty(); err != nil {
 			return err
+		} else if empty {
+			log.Infow("no sectors to simulate in the partition", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "set", set)
+			continue
 		}
 
-		tbs := blockstore.NewTieredBstore(blockstore.NewAPIBlockstore(nodeApi), blockstore.NewMemory())
-		mas, err := miner.Load(adt.WrapStore(context.Background(), cbor.NewCborStore(tbs)), mact)
-		if err != nil {
+		if err := emulateSectors(src, p, deadlineID, idx, sectors, nil, rep); err != nil {
 			return err
 		}
 
-		dl, err := mas.LoadDeadline(uint64(deadlineID))
+		if pr := rep.Partitions[len(rep.Partitions)-1]; pr.Status != statusOK {
+			log.Warnw("wdpost emulator err", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "status", pr.Status, "err", pr.Error)
+			continue
+		}
+
+		log.Infow("wdpost simulation is successful", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "sids", rep.okSectors(maddr.String(), deadlineID, idx))
+	}
+
+	return nil
+}
+
+// emulateSectors simulates one WindowPoSt over the sectors and adds the
+// results to rep. Sectors missing from the on-chain sectors array are
+// reported as substitutes, with the reason from issues if it is known.
+func emulateSectors(src sectorSource, p *util.Provider, dlIdx, partIdx int, sectors bitfield.BitField, issues map[abi.SectorNumber]string, rep *report) error {
+	maddr := src.actor()
+	amid, err := addr.IDFromAddress(maddr)
+	if err != nil {
+		return err
+	}
+
+	sInfo, substitutes, err := src.sectorInfo(sectors)
+	if err != nil {
+		return err
+	}
+
+	if len(substitutes) != 0 && issues == nil {
+		subs := bitfield.New()
+		for _, s := range substitutes {
+			subs.Set(uint64(s))
+		}
+
+		issues, err = src.explain(subs)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = dl.ForEachPartition(func(idx uint64, part miner.Partition) error {
-			liveSector, err := part.LiveSectors()
-			if err != nil {
-				return err
-			}
+	var res *emulationResult
+	if len(sInfo) != 0 {
+		res, err = wdpostEmulator(p, abi.ActorID(amid), sInfo)
+	} else {
+		err = xerrors.New("none of the sectors was found on chain")
+	}
 
-			sInfo, err := getSectorInfo(nodeApi, maddr, liveSector)
-			if err != nil {
-				return err
-			}
+	rep.add(p, maddr, dlIdx, partIdx, sInfo, substitutes, issues, res, err)
+	return nil
+}
 
-			err = wdpostEmulator(util.NewProvider(sdir), abi.ActorID(amid), sInfo)
-			if err != nil {
-				log.Warnw("wdpost emulator err", "deadlineID", deadlineID, "partitionID", idx)
-				return err
-			}
+// finishReport prints the report, keeps it in the history, hands it to the
+// metrics and alert sinks and returns an error if any partition failed.
+func finishReport(cctx *cli.Context, rep *report) error {
+	if err := rep.print(cctx); err != nil {
+		return err
+	}
 
-			sids, _ := liveSector.All(1000000)
-			log.Infow("wdpost simulation is successful", "sids", sids)
-			return nil
-		})
+	recordHistory(lcli.ReqContext(cctx), cctx.String(historyRepoFlag.Name), rep)
 
+	if err := pushReport(cctx, rep); err != nil {
+		return err
+	}
+
+	if err := notifyReport(cctx, rep); err != nil {
+		return err
+	}
+
+	if n := rep.failed(); n != 0 {
+		return xerrors.Errorf("wdpost simulation failed for %d partition(s)", n)
+	}
+
+	return nil
+}
+
+var sectorSetFlag = &cli.StringFlag{
+	Name:  "set",
+	Usage: "sectors of the partition to simulate: live, active, faulty or recovering",
+	Value: "live",
+}
+
+// partitionSectors selects the sectors of the partition named by set.
+func partitionSectors(part miner.Partition, set string) (bitfield.BitField, error) {
+	switch set {
+	case "live":
+		return part.LiveSectors()
+	case "active":
+		return part.ActiveSectors()
+	case "faulty":
+		return part.FaultySectors()
+	case "recovering":
+		return part.RecoveringSectors()
+	default:
+		return bitfield.BitField{}, xerrors.Errorf("unknown sector set: %s", set)
+	}
+}
+
+func checkSectorSet(cctx *cli.Context) error {
+	switch cctx.String("set") {
+	case "live", "active", "faulty", "recovering":
 		return nil
-	},
+	default:
+		return xerrors.Errorf("unknown --set: %s", cctx.String("set"))
+	}
 }
 
-func getSdir(cctx *cli.Context) (string, error) {
-	sdir := cctx.String("sdir")
-	if sdir == "" {
-		return "", xerrors.New("--sdir err")
+// parseActorSectors parses a comma separated list of sector ids. With one
+// actor the ids are plain numbers, with several each is prefixed with its
+// actor, ps: f01234:1.
+func parseActorSectors(sidsStr string, actors []addr.Address) (map[addr.Address]bitfield.BitField, error) {
+	known := map[addr.Address]struct{}{}
+	for _, a := range actors {
+		known[a] = struct{}{}
 	}
-	return sdir, nil
+
+	out := map[addr.Address]bitfield.BitField{}
+	for _, id := range strings.Split(sidsStr, ",") {
+		var maddr addr.Address
+		if i := strings.LastIndex(id, ":"); i >= 0 {
+			var err error
+			if maddr, err = addr.NewFromString(id[:i]); err != nil {
+				return nil, xerrors.Errorf("parsing actor of %s: %w", id, err)
+			}
+			if _, ok := known[maddr]; !ok {
+				return nil, xerrors.Errorf("actor of %s is not in --actor", id)
+			}
+			id = id[i+1:]
+		} else if len(actors) == 1 {
+			maddr = actors[0]
+		} else {
+			return nil, xerrors.Errorf("sector id %s needs its actor, ps: %s:%s", id, actors[0], id)
+		}
+
+		sid, err := strconv.Atoi(id)
+		if err != nil {
+			log.Warnw("sector id parsing failed", "id", id)
+			continue
+		}
+
+		sbit, ok := out[maddr]
+		if !ok {
+			sbit = bitfield.New()
+		}
+		sbit.Set(uint64(sid))
+		out[maddr] = sbit
+	}
+
+	return out, nil
 }
 
-func getSectorInfo(nodeApi api.FullNode, maddr addr.Address, sectors bitfield.BitField) ([]proof.SectorInfo, error) {
-	ss, err := nodeApi.StateMinerSectors(context.Background(), maddr, &sectors, types.EmptyTSK)
-	if err != nil || len(ss) == 0 {
-		return nil, err
+var (
+	minerRepoFlag = &cli.StringFlag{
+		Name:  "miner-repo",
+		Usage: "read the storage paths from the storage.json and sectorstore.json of this lotus-miner repo",
+	}
+	fromMinerFlag = &cli.BoolFlag{
+		Name:  "from-miner",
+		Usage: "ask the miner in MINER_API_INFO for its storage paths",
+	}
+	withSealFlag = &cli.BoolFlag{
+		Name:  "with-seal",
+		Usage: "also look for sectors in discovered paths which can only seal",
+	}
+)
+
+// getStoragePaths returns the storage paths given by --sdir, or discovered
+// from --miner-repo or --from-miner.
+func getStoragePaths(cctx *cli.Context) ([]util.StoragePath, error) {
+	var paths []util.StoragePath
+	switch {
+	case cctx.String("sdir") != "":
+		return util.ParseStoragePaths(cctx.String("sdir")), nil
+	case cctx.String(minerRepoFlag.Name) != "":
+		var err error
+		paths, err = util.RepoStoragePaths(cctx.String(minerRepoFlag.Name))
+		if err != nil {
+			return nil, err
+		}
+	case cctx.Bool(fromMinerFlag.Name):
+		minerApi, closer, err := lcli.GetStorageMinerAPI(cctx)
+		if err != nil {
+			return nil, err
+		}
+		defer closer()
+
+		paths, err = util.MinerStoragePaths(lcli.ReqContext(cctx), minerApi)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, xerrors.New("one of --sdir, --miner-repo or --from-miner is required")
+	}
+
+	paths = util.SelectStoragePaths(paths, cctx.Bool(withSealFlag.Name))
+	if len(paths) == 0 {
+		return nil, xerrors.New("no storage path found")
+	}
+
+	for _, p := range paths {
+		log.Infow("using storage path", "root", p.Root, "id", p.ID, "weight", p.Weight, "seal", p.CanSeal, "store", p.CanStore, "readonly", p.ReadOnly)
 	}
 
-	substitute := proof.SectorInfo{
-		SectorNumber: ss[0].SectorNumber,
-		SealedCID:    ss[0].SealedCID,
-		SealProof:    ss[0].SealProof,
+	return paths, nil
+}
+
+// getSectorInfo returns the proof info of the sectors. Sectors which are not
+// in the on-chain sectors array are returned as substitutes, and a stand-in
+// sector is proven in their place so that the proof keeps its size.
+func getSectorInfo(nodeApi api.FullNode, maddr addr.Address, sectors bitfield.BitField, tsk types.TipSetKey) ([]proof.SectorInfo, []abi.SectorNumber, error) {
+	ss, err := nodeApi.StateMinerSectors(context.Background(), maddr, &sectors, tsk)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	sectorByID := make(map[uint64]proof.SectorInfo, len(ss))
@@ -330,47 +614,211 @@ func getSectorInfo(nodeApi api.FullNode, maddr addr.Address, sectors bitfield.Bi
 		}
 	}
 
-	proofSectors := make([]proof.SectorInfo, 0, len(ss))
+	return withSubstitutes(sectors, sectorByID)
+}
+
+// withSubstitutes returns the proof info of the sectors found in sectorByID,
+// followed by a copy of the lowest found sector for each missing one.
+func withSubstitutes(sectors bitfield.BitField, sectorByID map[uint64]proof.SectorInfo) ([]proof.SectorInfo, []abi.SectorNumber, error) {
+	var substitutes []abi.SectorNumber
+	proofSectors := make([]proof.SectorInfo, 0, len(sectorByID))
 	if err := sectors.ForEach(func(sectorNo uint64) error {
 		if info, found := sectorByID[sectorNo]; found {
 			proofSectors = append(proofSectors, info)
 		} else {
-			proofSectors = append(proofSectors, substitute)
+			substitutes = append(substitutes, abi.SectorNumber(sectorNo))
 		}
 		return nil
 	}); err != nil {
-		return nil, xerrors.Errorf("iterating partition sector bitmap: %w", err)
+		return nil, nil, xerrors.Errorf("iterating partition sector bitmap: %w", err)
+	}
+
+	if len(proofSectors) != 0 {
+		substitute := proofSectors[0]
+		for range substitutes {
+			proofSectors = append(proofSectors, substitute)
+		}
 	}
 
-	return proofSectors, nil
+	return proofSectors, substitutes, nil
 }
 
-func wdpostEmulator(e util.Emulator, aid abi.ActorID, sInfo []proof.SectorInfo) error {
-	var challenge [32]byte
-	rand.Read(challenge[:])
-	proofs, faulty, skp, err := e.GenerateWindowPoSt(context.Background(), aid, sInfo, challenge[:])
+// explainSectors returns the reason why each of the sectors is not live on
+// chain at ts. Live sectors are left out of the result.
+func explainSectors(nodeApi api.FullNode, maddr addr.Address, sectors bitfield.BitField, ts *types.TipSet) (map[abi.SectorNumber]string, error) {
+	mas, err := loadMinerState(nodeApi, maddr, ts.Key())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(skp) != 0 {
-		log.Error("skip sectors: ", skp)
+	issues := map[abi.SectorNumber]string{}
+	err = sectors.ForEach(func(sectorNo uint64) error {
+		sid := abi.SectorNumber(sectorNo)
+
+		info, err := mas.GetSector(sid)
+		if err != nil {
+			return err
+		}
+
+		if info == nil {
+			pci, err := mas.GetPrecommittedSector(sid)
+			if err != nil {
+				return err
+			}
+			if pci != nil {
+				issues[sid] = "precommitted but not proven yet"
+				return nil
+			}
+
+			allocated, err := mas.IsAllocated(sid)
+			if err != nil {
+				return err
+			}
+			if allocated {
+				issues[sid] = "removed from the sectors array, it expired or was terminated"
+			} else {
+				issues[sid] = "never existed"
+			}
+			return nil
+		}
+
+		if info.Expiration <= ts.Height() {
+			issues[sid] = fmt.Sprintf("expired at epoch %d", info.Expiration)
+			return nil
+		}
+
+		loc, err := mas.FindSector(sid)
+		if err != nil {
+			issues[sid] = "not assigned to any partition"
+			return nil
+		}
+
+		dl, err := mas.LoadDeadline(loc.Deadline)
+		if err != nil {
+			return err
+		}
+
+		part, err := dl.LoadPartition(loc.Partition)
+		if err != nil {
+			return err
+		}
+
+		live, err := part.LiveSectors()
+		if err != nil {
+			return err
+		}
+
+		if isLive, err := live.IsSet(sectorNo); err != nil {
+			return err
+		} else if !isLive {
+			issues[sid] = "terminated"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("checking sectors on chain: %w", err)
 	}
 
-	if len(faulty) != 0 {
-		log.Error("faulty sectors: ", faulty)
+	return issues, nil
+}
+
+// wdpostEmulator proves the sectors the way the miner does: when sectors come
+// back faulty or skipped, the proof is generated again without them, each
+// replaced by the first good sector so that the proof keeps its size, and
+// only that proof is verified. The healthy sectors are then reported by the
+// outcome of a proof they really took part in.
+func wdpostEmulator(e util.Emulator, aid abi.ActorID, sInfo []proof.SectorInfo) (*emulationResult, error) {
+	var challenge [32]byte
+	rand.Read(challenge[:])
+
+	res := &emulationResult{}
+	bad := map[abi.SectorNumber]struct{}{}
+	proven := sInfo
+
+	var proofs []proof.PoStProof
+	for {
+		var (
+			faulty, skp []abi.SectorID
+			phases      util.PoStPhases
+			err         error
+		)
+
+		start := time.Now()
+		if pe, ok := e.(util.PhasedEmulator); ok {
+			proofs, faulty, skp, phases, err = pe.GenerateWindowPoStPhases(context.Background(), aid, proven, challenge[:])
+		} else {
+			proofs, faulty, skp, err = e.GenerateWindowPoSt(context.Background(), aid, proven, challenge[:])
+		}
+		elapsed := time.Since(start)
+		res.Acquire += phases.Acquire
+		res.Generate += elapsed
+		if len(bad) == 0 {
+			res.FirstGenerate = elapsed
+		}
+
+		if len(faulty) == 0 && len(skp) == 0 {
+			if err != nil {
+				return res, err
+			}
+			break
+		}
+
+		if len(skp) != 0 {
+			log.Error("skip sectors: ", skp)
+		}
+		if len(faulty) != 0 {
+			log.Error("faulty sectors: ", faulty)
+		}
+
+		res.Faulty = append(res.Faulty, faulty...)
+		res.Skipped = append(res.Skipped, skp...)
+		for _, s := range append(faulty, skp...) {
+			bad[s.Number] = struct{}{}
+		}
+
+		if proven = substituteBad(sInfo, bad); proven == nil {
+			return res, xerrors.New("none of the sectors could be proven")
+		}
+		log.Warnw("proving again without the faulty and skipped sectors", "miner", aid, "excluded", len(bad))
 	}
 
+	start := time.Now()
 	ok, err := ffiwrapper.ProofVerifier.VerifyWindowPoSt(context.TODO(), proof.WindowPoStVerifyInfo{
 		Randomness:        challenge[:],
 		Proofs:            proofs,
-		ChallengedSectors: sInfo,
+		ChallengedSectors: proven,
 		Prover:            aid,
 	})
+	res.Verify = time.Since(start)
+	res.Verified = ok && err == nil
 	if err != nil || !ok {
 		log.Error("window post verification failed")
-		return err
+		return res, err
 	}
 
-	return nil
+	return res, nil
+}
+
+// substituteBad replaces each sector of bad in sInfo with the first sector
+// which is not bad. It returns nil if all sectors are bad.
+func substituteBad(sInfo []proof.SectorInfo, bad map[abi.SectorNumber]struct{}) []proof.SectorInfo {
+	var good *proof.SectorInfo
+	for i := range sInfo {
+		if _, ok := bad[sInfo[i].SectorNumber]; !ok {
+			good = &sInfo[i]
+			break
+		}
+	}
+	if good == nil {
+		return nil
+	}
+
+	out := make([]proof.SectorInfo, len(sInfo))
+	for i, s := range sInfo {
+		if _, ok := bad[s.SectorNumber]; ok {
+			s = *good
+		}
+		out[i] = s
+	}
+	return out
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	addr "github.com/filecoin-project/go-address"
+	"reflect"
+	"testing"
+)
+
+func TestParseActorSectors(t *testing.T) {
+	a1, err := addr.NewFromString("f01234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := addr.NewFromString("f05678")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		sids   string
+		actors []addr.Address
+		want   map[addr.Address][]uint64
+		err    bool
+	}{
+		{name: "single actor", sids: "1,2,10", actors: []addr.Address{a1}, want: map[addr.Address][]uint64{a1: {1, 2, 10}}},
+		{name: "single actor with prefix", sids: "f01234:3,4", actors: []addr.Address{a1}, want: map[addr.Address][]uint64{a1: {3, 4}}},
+		{name: "several actors", sids: "f01234:1,f05678:1,f05678:7", actors: []addr.Address{a1, a2},
+			want: map[addr.Address][]uint64{a1: {1}, a2: {1, 7}}},
+		{name: "invalid sector skipped", sids: "1,x,3", actors: []addr.Address{a1}, want: map[addr.Address][]uint64{a1: {1, 3}}},
+		{name: "missing actor", sids: "f01234:1,2", actors: []addr.Address{a1, a2}, err: true},
+		{name: "unknown actor", sids: "f09999:1", actors: []addr.Address{a1, a2}, err: true},
+		{name: "invalid actor", sids: "fx:1", actors: []addr.Address{a1}, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := parseActorSectors(tc.sids, tc.actors)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[addr.Address][]uint64{}
+			for maddr, bf := range out {
+				if got[maddr], err = bf.All(1 << 20); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"path/filepath"
+)
+
+func init() {
+	cbor.RegisterCborType(sectorManifest{})
+	cbor.RegisterCborType(manifestSector{})
+}
+
+// sectorManifest holds the live sectors of a miner at a height, with what
+// the emulators need to run without a full node.
+type sectorManifest struct {
+	Miner  string         `json:"miner"`
+	Height abi.ChainEpoch `json:"height"`
+	// block cids of the tipset the sectors were read at
+	Tipset           []cid.Cid `json:"tipset,omitempty"`
+	PartitionsPerMsg int       `json:"partitions_per_message"`
+	// number of partitions of each deadline
+	Partitions []int            `json:"partitions"`
+	Sectors    []manifestSector `json:"sectors"`
+}
+
+type manifestSector struct {
+	Number    abi.SectorNumber        `json:"number"`
+	SealProof abi.RegisteredSealProof `json:"seal_proof"`
+	SealedCID cid.Cid                 `json:"sealed_cid"`
+	// has a sector key, proven with the update files
+	Updated    bool   `json:"updated"`
+	Deadline   uint64 `json:"deadline"`
+	Partition  uint64 `json:"partition"`
+	Active     bool   `json:"active"`
+	Faulty     bool   `json:"faulty"`
+	Recovering bool   `json:"recovering"`
+}
+
+var exportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "write the live sectors of the miner to a manifest for offline simulations",
+	ArgsUsage: "[manifest.json|manifest.cbor]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor id",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.New("expected the path of the manifest")
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ctx := lcli.ReqContext(cctx)
+
+		maddr, err := util.GetActorAddress(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(ctx, cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		perMsg, err := maxPartitionsPerMessage(nodeApi, maddr, ts.Key())
+		if err != nil {
+			return err
+		}
+
+		mas, err := loadMinerState(nodeApi, maddr, ts.Key())
+		if err != nil {
+			return err
+		}
+
+		m := &sectorManifest{
+			Miner:            maddr.String(),
+			Height:           ts.Height(),
+			Tipset:           ts.Cids(),
+			PartitionsPerMsg: perMsg,
+			Partitions:       make([]int, miner.WPoStPeriodDeadlines),
+		}
+
+		err = mas.ForEachDeadline(func(dlIdx uint64, dl miner.Deadline) error {
+			return dl.ForEachPartition(func(partIdx uint64, part miner.Partition) error {
+				m.Partitions[dlIdx]++
+
+				live, err := part.LiveSectors()
+				if err != nil {
+					return err
+				}
+				active, err := part.ActiveSectors()
+				if err != nil {
+					return err
+				}
+				faulty, err := part.FaultySectors()
+				if err != nil {
+					return err
+				}
+				recovering, err := part.RecoveringSectors()
+				if err != nil {
+					return err
+				}
+
+				infos, err := nodeApi.StateMinerSectors(ctx, maddr, &live, ts.Key())
+				if err != nil {
+					return xerrors.Errorf("getting sectors of deadline %d partition %d: %w", dlIdx, partIdx, err)
+				}
+
+				for _, info := range infos {
+					ms := manifestSector{
+						Number:    info.SectorNumber,
+						SealProof: info.SealProof,
+						SealedCID: info.SealedCID,
+						Updated:   info.SectorKeyCID != nil,
+						Deadline:  dlIdx,
+						Partition: partIdx,
+					}
+					if ms.Active, err = active.IsSet(uint64(info.SectorNumber)); err != nil {
+						return err
+					}
+					if ms.Faulty, err = faulty.IsSet(uint64(info.SectorNumber)); err != nil {
+						return err
+					}
+					if ms.Recovering, err = recovering.IsSet(uint64(info.SectorNumber)); err != nil {
+						return err
+					}
+					m.Sectors = append(m.Sectors, ms)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		mpath := cctx.Args().First()
+		var b []byte
+		if filepath.Ext(mpath) == ".cbor" {
+			b, err = cbor.DumpObject(m)
+		} else {
+			b, err = json.MarshalIndent(m, "", "  ")
+		}
+		if err != nil {
+			return xerrors.Errorf("encoding manifest: %w", err)
+		}
+
+		if err := ioutil.WriteFile(mpath, b, 0644); err != nil {
+			return xerrors.Errorf("writing manifest: %w", err)
+		}
+
+		log.Infow("manifest written", "manifest", mpath, "miner", m.Miner, "height", m.Height, "sectors", len(m.Sectors))
+		return nil
+	},
+}
+
+// loadSectorManifest reads a manifest written by export, in CBOR if the file
+// name ends with .cbor, else in JSON.
+func loadSectorManifest(mpath string) (*sectorManifest, error) {
+	b, err := ioutil.ReadFile(mpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var m sectorManifest
+	if filepath.Ext(mpath) == ".cbor" {
+		err = cbor.DecodeInto(b, &m)
+	} else {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("decoding manifest: %w", err)
+	}
+
+	return &m, nil
+}
+
+type manifestSource struct {
+	m        *sectorManifest
+	maddr    addr.Address
+	byNumber map[abi.SectorNumber]*manifestSector
+}
+
+func newManifestSource(m *sectorManifest) (*manifestSource, error) {
+	maddr, err := addr.NewFromString(m.Miner)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing manifest miner: %w", err)
+	}
+
+	s := &manifestSource{
+		m:        m,
+		maddr:    maddr,
+		byNumber: make(map[abi.SectorNumber]*manifestSector, len(m.Sectors)),
+	}
+	for i := range m.Sectors {
+		s.byNumber[m.Sectors[i].Number] = &m.Sectors[i]
+	}
+	return s, nil
+}
+
+func (s *manifestSource) partitions(deadlineID int, set string) ([]bitfield.BitField, error) {
+	if deadlineID >= len(s.m.Partitions) {
+		return nil, xerrors.Errorf("deadline %d not in the manifest", deadlineID)
+	}
+
+	out := make([]bitfield.BitField, s.m.Partitions[deadlineID])
+	for i := range out {
+		out[i] = bitfield.New()
+	}
+
+	for _, ms := range s.m.Sectors {
+		if ms.Deadline != uint64(deadlineID) || ms.Partition >= uint64(len(out)) {
+			continue
+		}
+
+		var in bool
+		switch set {
+		case "live":
+			in = true
+		case "active":
+			in = ms.Active
+		case "faulty":
+			in = ms.Faulty
+		case "recovering":
+			in = ms.Recovering
+		default:
+			return nil, xerrors.Errorf("unknown sector set: %s", set)
+		}
+
+		if in {
+			out[ms.Partition].Set(uint64(ms.Number))
+		}
+	}
+
+	return out, nil
+}
+
+func (s *manifestSource) sectorInfo(sectors bitfield.BitField) ([]proof.SectorInfo, []abi.SectorNumber, error) {
+	byID := map[uint64]proof.SectorInfo{}
+	err := sectors.ForEach(func(sectorNo uint64) error {
+		if ms, ok := s.byNumber[abi.SectorNumber(sectorNo)]; ok {
+			byID[sectorNo] = proof.SectorInfo{
+				SealProof:    ms.SealProof,
+				SectorNumber: ms.Number,
+				SealedCID:    ms.SealedCID,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return withSubstitutes(sectors, byID)
+}
+
+func (s *manifestSource) explain(sectors bitfield.BitField) (map[abi.SectorNumber]string, error) {
+	issues := map[abi.SectorNumber]string{}
+	err := sectors.ForEach(func(sectorNo uint64) error {
+		if _, ok := s.byNumber[abi.SectorNumber(sectorNo)]; !ok {
+			issues[abi.SectorNumber(sectorNo)] = "not live when the manifest was exported"
+		}
+		return nil
+	})
+	return issues, err
+}
+
+func (s *manifestSource) partitionsPerMessage() (int, error) {
+	if s.m.PartitionsPerMsg <= 0 {
+		return 0, xerrors.New("the manifest has no partitions per message")
+	}
+	return s.m.PartitionsPerMsg, nil
+}
+
+func (s *manifestSource) postProof() (abi.RegisteredPoStProof, error) {
+	if len(s.m.Sectors) == 0 {
+		return 0, xerrors.New("the manifest has no sectors")
+	}
+	return s.m.Sectors[0].SealProof.RegisteredWindowPoStProof()
+}
+
+func (s *manifestSource) tipset() (abi.ChainEpoch, types.TipSetKey) {
+	return s.m.Height, types.NewTipSetKey(s.m.Tipset...)
+}
+
+func (s *manifestSource) attach(p *util.Provider) *util.Provider {
+	mid, err := addr.IDFromAddress(s.maddr)
+	if err != nil {
+		log.Warnw("snapped sectors of the manifest are not recognized", "miner", s.maddr, "err", err)
+		return p
+	}
+
+	var updated []abi.SectorID
+	for _, ms := range s.m.Sectors {
+		if ms.Updated {
+			updated = append(updated, abi.SectorID{Miner: abi.ActorID(mid), Number: ms.Number})
+		}
+	}
+	return p.UseUpdated(updated)
+}
+
+func (s *manifestSource) actor() addr.Address {
+	return s.maddr
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var metricsPushFlag = &cli.StringFlag{
+	Name:  "metrics-push",
+	Usage: "push sector health metrics to this prometheus pushgateway url after the simulation",
+}
+
+var (
+	partitionLabels = []string{"miner", "deadline", "partition"}
+	pathLabels      = []string{"miner", "deadline", "partition", "path"}
+)
+
+// sectorHealth exports the results of simulated proofs as prometheus metrics.
+type sectorHealth struct {
+	registry *prometheus.Registry
+
+	checked   *prometheus.GaugeVec
+	faulty    *prometheus.GaugeVec
+	skipped   *prometheus.GaugeVec
+	duration  *prometheus.GaugeVec
+	verified  *prometheus.GaugeVec
+	lastCheck *prometheus.GaugeVec
+
+	lk sync.Mutex
+	// storage paths reported by the last check of each partition, so that
+	// series of paths which no longer hold any sector can be removed
+	paths map[[3]string][]string
+}
+
+func newSectorHealth() *sectorHealth {
+	gauge := func(name, help string, labels []string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "lotus_wdpost",
+			Name:      name,
+			Help:      help,
+		}, labels)
+	}
+
+	h := &sectorHealth{
+		registry:  prometheus.NewRegistry(),
+		checked:   gauge("sectors_checked", "number of sectors checked, by storage path", pathLabels),
+		faulty:    gauge("sectors_faulty", "number of faulty sectors, by storage path", pathLabels),
+		skipped:   gauge("sectors_skipped", "number of sectors skipped because files are missing, by storage path of the file found", pathLabels),
+		duration:  gauge("proof_generation_seconds", "time taken to generate the partition proof", partitionLabels),
+		verified:  gauge("proof_verified", "1 if the partition proof was verified, 0 otherwise", partitionLabels),
+		lastCheck: gauge("last_check_timestamp_seconds", "unix time of the last check of the partition", partitionLabels),
+		paths:     map[[3]string][]string{},
+	}
+
+	h.registry.MustRegister(h.checked, h.faulty, h.skipped, h.duration, h.verified, h.lastCheck)
+	return h
+}
+
+func (h *sectorHealth) record(rep *report) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	now := float64(time.Now().Unix())
+
+	type counts struct{ checked, faulty, skipped int }
+	byPath := map[[3]string]map[string]*counts{}
+
+	for _, p := range rep.Partitions {
+		verified := 0.0
+		if p.Status != statusFailed {
+			verified = 1
+		}
+
+		// a batch is proven at once, each of its partitions gets its result
+		parts := p.Batch
+		if len(parts) == 0 {
+			parts = []int{p.Partition}
+		}
+		for _, idx := range parts {
+			key := [3]string{p.Miner, strconv.Itoa(p.Deadline), strconv.Itoa(idx)}
+			byPath[key] = map[string]*counts{}
+
+			h.duration.WithLabelValues(key[:]...).Set(float64(p.GenerateMs) / 1000)
+			h.verified.WithLabelValues(key[:]...).Set(verified)
+			h.lastCheck.WithLabelValues(key[:]...).Set(now)
+		}
+	}
+
+	for _, s := range rep.Sectors {
+		key := [3]string{s.Miner, strconv.Itoa(s.Deadline), strconv.Itoa(s.Partition)}
+
+		path := s.SealedDir
+		if path == "" {
+			path = s.CacheDir
+		}
+
+		paths, ok := byPath[key]
+		if !ok {
+			paths = map[string]*counts{}
+			byPath[key] = paths
+		}
+		c, ok := paths[path]
+		if !ok {
+			c = &counts{}
+			paths[path] = c
+		}
+
+		c.checked++
+		switch s.Status {
+		case statusFaulty:
+			c.faulty++
+		case statusSkipped:
+			c.skipped++
+		}
+	}
+
+	for key, paths := range byPath {
+		for _, old := range h.paths[key] {
+			if _, ok := paths[old]; !ok {
+				labels := append(key[:], old)
+				h.checked.DeleteLabelValues(labels...)
+				h.faulty.DeleteLabelValues(labels...)
+				h.skipped.DeleteLabelValues(labels...)
+			}
+		}
+
+		h.paths[key] = h.paths[key][:0]
+		for path, c := range paths {
+			labels := append(key[:], path)
+			h.checked.WithLabelValues(labels...).Set(float64(c.checked))
+			h.faulty.WithLabelValues(labels...).Set(float64(c.faulty))
+			h.skipped.WithLabelValues(labels...).Set(float64(c.skipped))
+			h.paths[key] = append(h.paths[key], path)
+		}
+	}
+}
+
+func (h *sectorHealth) serve(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(h.registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		log.Infow("serving metrics", "listen", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Errorw("metrics server stopped", "err", err)
+		}
+	}()
+}
+
+func (h *sectorHealth) push(url string) error {
+	if err := push.New(url, "lotus_wdpost").Gatherer(h.registry).Push(); err != nil {
+		return xerrors.Errorf("pushing metrics to %s: %w", url, err)
+	}
+	return nil
+}
+
+// pushReport pushes the report to the pushgateway given by --metrics-push, if any.
+func pushReport(cctx *cli.Context, rep *report) error {
+	url := cctx.String("metrics-push")
+	if url == "" {
+		return nil
+	}
+
+	h := newSectorHealth()
+	h.record(rep)
+	return h.push(url)
+}
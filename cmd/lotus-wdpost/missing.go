@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/ipfs/go-cid"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type missingSector struct {
+	Sector  uint64   `json:"sector"`
+	Missing []string `json:"missing"`
+	// snapped with SnapDeals, or holding deals
+	Updated bool `json:"updated,omitempty"`
+	Deals   bool `json:"deals,omitempty"`
+}
+
+// noRedo returns why lotus-redo can't rebuild the sector: it reseals a CC
+// sector with null pieces, whose replica only matches the on-chain SealedCID
+// if the sector holds no data.
+func (s missingSector) noRedo() string {
+	switch {
+	case s.Updated:
+		return "snapped"
+	case s.Deals:
+		return "has deals"
+	}
+	return ""
+}
+
+type missingPartition struct {
+	Miner     string          `json:"miner"`
+	Deadline  uint64          `json:"deadline"`
+	Partition uint64          `json:"partition"`
+	Open      abi.ChainEpoch  `json:"open"`
+	Height    abi.ChainEpoch  `json:"height"`
+	Tipset    []cid.Cid       `json:"tipset"`
+	Sectors   []missingSector `json:"sectors"`
+}
+
+var missingCmd = &cli.Command{
+	Name:  "missing",
+	Usage: "find sectors on chain whose sealed or cache files are in none of the storage paths",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		sectorSetFlag,
+		util.TipSetFlag,
+		util.HeightFlag,
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: table, json, or sids for a comma separated list which lotus-redo --sids accepts, one line per actor. Sectors lotus-redo can't rebuild are left out",
+			Value: "table",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		output := cctx.String("output")
+		if output != "table" && output != "json" && output != "sids" {
+			return xerrors.Errorf("unknown --output format: %s", output)
+		}
+		if err := checkSectorSet(cctx); err != nil {
+			return err
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(lcli.ReqContext(cctx), cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		// the sectors of all actors are looked up in one index
+		p := util.NewProviderFromPaths(paths)
+
+		var parts []missingPartition
+		for _, maddr := range maddrs {
+			mp, err := findMissing(nodeApi, ts, p, maddr, cctx.String("set"))
+			if err != nil {
+				return xerrors.Errorf("miner %s: %w", maddr, err)
+			}
+			parts = append(parts, mp...)
+		}
+
+		sort.SliceStable(parts, func(i, j int) bool {
+			return parts[i].Open < parts[j].Open
+		})
+
+		switch output {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(parts)
+		case "sids":
+			sids := map[string][]string{}
+			for _, p := range parts {
+				for _, s := range p.Sectors {
+					if reason := s.noRedo(); reason != "" {
+						log.Warnw("sector left out, lotus-redo reseals it as CC which won't match its sealed cid", "miner", p.Miner, "sector", s.Sector, "reason", reason)
+						continue
+					}
+					sids[p.Miner] = append(sids[p.Miner], strconv.FormatUint(s.Sector, 10))
+				}
+			}
+			for _, maddr := range maddrs {
+				if len(maddrs) > 1 {
+					fmt.Printf("%s ", maddr)
+				}
+				fmt.Println(strings.Join(sids[maddr.String()], ","))
+			}
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "MINER\tOPEN\tDEADLINE\tPARTITION\tSECTOR\tMISSING\tNO_REDO")
+		for _, p := range parts {
+			for _, s := range p.Sectors {
+				_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", p.Miner, p.Open, p.Deadline, p.Partition, s.Sector, strings.Join(s.Missing, ","), s.noRedo())
+			}
+		}
+		return tw.Flush()
+	},
+}
+
+// findMissing checks every sector of the set in every partition of the miner
+// against the sector index, looking for the update files of snapped sectors.
+// The result is ordered by the epoch at which the deadline of the partition
+// opens next, so the most urgent come first. The chain state is read at ts.
+func findMissing(nodeApi api.FullNode, ts *types.TipSet, p *util.Provider, maddr addr.Address, set string) ([]missingPartition, error) {
+	mid, err := addr.IDFromAddress(maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := p.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	di, err := nodeApi.StateMinerProvingDeadline(context.Background(), maddr, ts.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proving deadline: %w", err)
+	}
+
+	mas, err := loadMinerState(nodeApi, maddr, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	var out []missingPartition
+	err = mas.ForEachDeadline(func(dlIdx uint64, dl miner.Deadline) error {
+		dlInfo := dline.NewInfo(di.PeriodStart, dlIdx, di.CurrentEpoch, di.WPoStPeriodDeadlines, di.WPoStProvingPeriod,
+			di.WPoStChallengeWindow, di.WPoStChallengeLookback, di.FaultDeclarationCutoff).NextNotElapsed()
+
+		return dl.ForEachPartition(func(partIdx uint64, part miner.Partition) error {
+			sectors, err := partitionSectors(part, set)
+			if err != nil {
+				return err
+			}
+
+			mp := missingPartition{
+				Miner:     maddr.String(),
+				Deadline:  dlIdx,
+				Partition: partIdx,
+				Open:      dlInfo.Open,
+				Height:    ts.Height(),
+				Tipset:    ts.Cids(),
+			}
+
+			infos, err := nodeApi.StateMinerSectors(context.Background(), maddr, &sectors, ts.Key())
+			if err != nil {
+				return xerrors.Errorf("getting sector infos: %w", err)
+			}
+			updated := map[uint64]bool{}
+			deals := map[uint64]bool{}
+			for _, info := range infos {
+				updated[uint64(info.SectorNumber)] = info.SectorKeyCID != nil
+				deals[uint64(info.SectorNumber)] = len(info.DealIDs) != 0
+			}
+
+			err = sectors.ForEach(func(sectorNo uint64) error {
+				sid := abi.SectorID{Miner: abi.ActorID(mid), Number: abi.SectorNumber(sectorNo)}
+
+				// snapped sectors are proven with their update files
+				fts := []storiface.SectorFileType{storiface.FTSealed, storiface.FTCache}
+				if updated[sectorNo] {
+					fts = []storiface.SectorFileType{storiface.FTUpdate, storiface.FTUpdateCache}
+				}
+
+				var missing []string
+				for _, ft := range fts {
+					if len(idx.Roots(sid, ft)) == 0 {
+						missing = append(missing, ft.String())
+					}
+				}
+
+				if len(missing) != 0 {
+					mp.Sectors = append(mp.Sectors, missingSector{
+						Sector:  sectorNo,
+						Missing: missing,
+						Updated: updated[sectorNo],
+						Deals:   deals[sectorNo],
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(mp.Sectors) != 0 {
+				out = append(out, mp)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Open != out[j].Open {
+			return out[i].Open < out[j].Open
+		}
+		return out[i].Partition < out[j].Partition
+	})
+
+	return out, nil
+}
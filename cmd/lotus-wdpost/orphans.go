@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/ipfs/go-cid"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+const reasonUnallocated = "sector number not allocated on chain, it may still be sealing"
+
+// orphanFileTypes are the sector files a scan lists, and the only ones
+// removed.
+var orphanFileTypes = []storiface.SectorFileType{storiface.FTUnsealed, storiface.FTSealed, storiface.FTCache, storiface.FTUpdate, storiface.FTUpdateCache}
+
+type orphanFile struct {
+	Root string `json:"root"`
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type orphanSector struct {
+	Sector uint64       `json:"sector"`
+	Reason string       `json:"reason"`
+	Files  []orphanFile `json:"files"`
+}
+
+// orphanManifest lists the files found by a scan. Passing it back with
+// --delete or --quarantine confirms what may be removed.
+type orphanManifest struct {
+	Miner       string         `json:"miner"`
+	Height      abi.ChainEpoch `json:"height"`
+	Tipset      []cid.Cid      `json:"tipset,omitempty"`
+	Reclaimable int64          `json:"reclaimable"`
+	Sectors     []orphanSector `json:"sectors"`
+}
+
+var orphansCmd = &cli.Command{
+	Name:  "orphans",
+	Usage: "find sector files in the storage paths which are no longer live on chain",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		&cli.BoolFlag{
+			Name:  "include-unallocated",
+			Usage: "also list sectors whose number is not allocated on chain, which are usually still sealing",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+		&cli.StringFlag{
+			Name:  "manifest",
+			Usage: "write the scan result to this file, or with --delete / --quarantine read the files to remove from it",
+		},
+		&cli.BoolFlag{
+			Name:  "delete",
+			Usage: "delete the files listed in --manifest",
+		},
+		&cli.BoolFlag{
+			Name:  "quarantine",
+			Usage: "move the files listed in --manifest into the quarantine directory of their storage path",
+		},
+		&cli.BoolFlag{
+			Name:  "really-do-it",
+			Usage: "actually delete or move the files",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Bool("delete") && cctx.Bool("quarantine") {
+			return xerrors.New("--delete and --quarantine are mutually exclusive")
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("delete") || cctx.Bool("quarantine") {
+			// files are only removed if their sectors are still orphaned at the chain head
+			if cctx.IsSet(util.TipSetFlag.Name) || cctx.IsSet(util.HeightFlag.Name) {
+				return xerrors.New("--tipset and --height only apply to a scan")
+			}
+			return removeOrphans(cctx, nodeApi, maddrs, paths)
+		}
+
+		ts, err := util.GetTipSet(lcli.ReqContext(cctx), cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+
+		// the files of all actors are found in one index
+		p := util.NewProviderFromPaths(paths)
+
+		var manifests []*orphanManifest
+		for _, maddr := range maddrs {
+			m, err := scanOrphans(nodeApi, ts, maddr, p, cctx.Bool("include-unallocated"))
+			if err != nil {
+				return xerrors.Errorf("miner %s: %w", maddr, err)
+			}
+			manifests = append(manifests, m)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "MINER\tSECTOR\tTYPE\tPATH\tSIZE\tREASON")
+		for _, m := range manifests {
+			for _, s := range m.Sectors {
+				for _, f := range s.Files {
+					_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\n", m.Miner, s.Sector, f.Type, f.Path, f.Size, s.Reason)
+				}
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		for _, m := range manifests {
+			fmt.Printf("%s: %d orphaned sector(s), %s reclaimable\n", m.Miner, len(m.Sectors), types.SizeStr(types.NewInt(uint64(m.Reclaimable))))
+		}
+
+		if mpath := cctx.String("manifest"); mpath != "" {
+			var v interface{} = manifests
+			if len(manifests) == 1 {
+				v = manifests[0]
+			}
+			b, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(mpath, b, 0644); err != nil {
+				return xerrors.Errorf("writing manifest: %w", err)
+			}
+			log.Infow("manifest written, review it and pass it back with --delete or --quarantine", "manifest", mpath)
+		}
+
+		return nil
+	},
+}
+
+// scanOrphans lists the files of every sector of the miner in the storage
+// paths which is neither live nor precommitted on chain at ts.
+func scanOrphans(nodeApi api.FullNode, ts *types.TipSet, maddr addr.Address, p *util.Provider, withUnallocated bool) (*orphanManifest, error) {
+	mid, err := addr.IDFromAddress(maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := p.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []abi.SectorNumber
+	for _, sid := range idx.Sectors() {
+		if sid.Miner == abi.ActorID(mid) {
+			nums = append(nums, sid.Number)
+		}
+	}
+
+	reasons, err := orphanReasons(nodeApi, maddr, nums, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	m := &orphanManifest{
+		Miner:  maddr.String(),
+		Height: ts.Height(),
+		Tipset: ts.Cids(),
+	}
+
+	for _, num := range nums {
+		reason, ok := reasons[num]
+		if !ok || (reason == reasonUnallocated && !withUnallocated) {
+			continue
+		}
+
+		sid := abi.SectorID{Miner: abi.ActorID(mid), Number: num}
+		orphan := orphanSector{Sector: uint64(num), Reason: reason}
+
+		for _, sp := range p.Paths() {
+			for _, ft := range orphanFileTypes {
+				path := idx.Path(sp.Root, sid, ft)
+				size, err := util.PathSize(path)
+				if err != nil {
+					continue
+				}
+
+				orphan.Files = append(orphan.Files, orphanFile{Root: sp.Root, Type: ft.String(), Path: path, Size: size})
+				m.Reclaimable += size
+			}
+		}
+
+		m.Sectors = append(m.Sectors, orphan)
+	}
+
+	return m, nil
+}
+
+// orphanReasons returns why each of the sectors is orphaned at tsk. Sectors
+// which are live or precommitted are left out.
+func orphanReasons(nodeApi api.FullNode, maddr addr.Address, nums []abi.SectorNumber, tsk types.TipSetKey) (map[abi.SectorNumber]string, error) {
+	mas, err := loadMinerState(nodeApi, maddr, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	var lives []bitfield.BitField
+	err = mas.ForEachDeadline(func(_ uint64, dl miner.Deadline) error {
+		return dl.ForEachPartition(func(_ uint64, part miner.Partition) error {
+			live, err := part.LiveSectors()
+			if err != nil {
+				return err
+			}
+			lives = append(lives, live)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("loading live sectors: %w", err)
+	}
+
+	live, err := bitfield.MultiMerge(lives...)
+	if err != nil {
+		return nil, err
+	}
+
+	precommitted := map[abi.SectorNumber]struct{}{}
+	err = mas.ForEachPrecommittedSector(func(info miner.SectorPreCommitOnChainInfo) error {
+		precommitted[info.Info.SectorNumber] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("loading precommitted sectors: %w", err)
+	}
+
+	reasons := map[abi.SectorNumber]string{}
+	for _, num := range nums {
+		if isLive, err := live.IsSet(uint64(num)); err != nil {
+			return nil, err
+		} else if isLive {
+			continue
+		}
+
+		if _, ok := precommitted[num]; ok {
+			continue
+		}
+
+		allocated, err := mas.IsAllocated(num)
+		if err != nil {
+			return nil, err
+		}
+		if !allocated {
+			reasons[num] = reasonUnallocated
+			continue
+		}
+
+		info, err := mas.GetSector(num)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			reasons[num] = "expired or terminated"
+		} else {
+			reasons[num] = "expired, terminated or precommit expired"
+		}
+	}
+
+	return reasons, nil
+}
+
+// removeOrphans deletes or quarantines the files of the manifest, after
+// checking again that each sector is still orphaned and that its storage
+// path is configured and writable. The path of a file is never taken from
+// the manifest: it is built again from the root, the sector and the file
+// type, and the file is kept if the manifest says otherwise.
+func removeOrphans(cctx *cli.Context, nodeApi api.FullNode, maddrs []addr.Address, paths []util.StoragePath) error {
+	mpath := cctx.String("manifest")
+	if mpath == "" {
+		return xerrors.New("--manifest from a previous scan is required to remove files")
+	}
+
+	manifests, err := loadOrphanManifests(mpath)
+	if err != nil {
+		return err
+	}
+
+	actors := map[string]addr.Address{}
+	for _, maddr := range maddrs {
+		actors[maddr.String()] = maddr
+	}
+	for _, m := range manifests {
+		if _, ok := actors[m.Miner]; !ok {
+			return xerrors.Errorf("manifest is for miner %s, which is not in %v", m.Miner, maddrs)
+		}
+	}
+
+	roots := map[string]util.StoragePath{}
+	for _, sp := range paths {
+		roots[sp.Root] = sp
+	}
+
+	fileTypes := map[string]storiface.SectorFileType{}
+	for _, ft := range orphanFileTypes {
+		fileTypes[ft.String()] = ft
+	}
+
+	// only builds paths, the storage paths are not listed
+	var idx util.SectorIndex
+
+	quarantine := cctx.Bool("quarantine")
+	really := cctx.Bool("really-do-it")
+
+	action := "delete"
+	if quarantine {
+		action = "quarantine"
+	}
+
+	var removed int64
+	for _, m := range manifests {
+		maddr := actors[m.Miner]
+		mid, err := addr.IDFromAddress(maddr)
+		if err != nil {
+			return err
+		}
+
+		nums := make([]abi.SectorNumber, 0, len(m.Sectors))
+		for _, s := range m.Sectors {
+			nums = append(nums, abi.SectorNumber(s.Sector))
+		}
+
+		reasons, err := orphanReasons(nodeApi, maddr, nums, types.EmptyTSK)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range m.Sectors {
+			if _, orphan := reasons[abi.SectorNumber(s.Sector)]; !orphan {
+				log.Warnw("sector is live or precommitted now, keeping its files", "miner", maddr, "sector", s.Sector)
+				continue
+			}
+
+			for _, f := range s.Files {
+				sp, ok := roots[f.Root]
+				if !ok {
+					log.Warnw("storage path of the file is not configured, keeping it", "path", f.Path)
+					continue
+				}
+				if sp.ReadOnly {
+					log.Warnw("storage path is read-only, keeping the file", "path", f.Path)
+					continue
+				}
+
+				ft, ok := fileTypes[f.Type]
+				if !ok {
+					log.Warnw("unknown file type in the manifest, keeping the file", "type", f.Type, "path", f.Path)
+					continue
+				}
+				path := idx.Path(sp.Root, abi.SectorID{Miner: abi.ActorID(mid), Number: abi.SectorNumber(s.Sector)}, ft)
+				if filepath.Clean(f.Path) != path {
+					log.Warnw("path in the manifest is not the path of the sector file, keeping it", "path", f.Path, "expected", path)
+					continue
+				}
+				if _, err := os.Lstat(path); err != nil {
+					log.Warnw("sector file not found, skipping it", "path", path, "err", err)
+					continue
+				}
+
+				if !really {
+					fmt.Printf("would %s %s\n", action, path)
+					continue
+				}
+
+				if quarantine {
+					to := filepath.Join(sp.Root, "quarantine", ft.String(), filepath.Base(path))
+					if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+						return err
+					}
+					if err := os.Rename(path, to); err != nil {
+						return xerrors.Errorf("quarantining %s: %w", path, err)
+					}
+					log.Infow("file quarantined", "from", path, "to", to)
+				} else {
+					if err := os.RemoveAll(path); err != nil {
+						return xerrors.Errorf("deleting %s: %w", path, err)
+					}
+					log.Infow("file deleted", "path", path)
+				}
+				removed += f.Size
+			}
+		}
+	}
+
+	if !really {
+		_, _ = fmt.Fprintln(os.Stderr, "nothing was changed, pass --really-do-it to proceed")
+		return nil
+	}
+
+	fmt.Printf("%s of files %sd\n", types.SizeStr(types.NewInt(uint64(removed))), action)
+	return nil
+}
+
+// loadOrphanManifests reads a manifest written by a scan: one manifest, or
+// a list of them when several actors were scanned.
+func loadOrphanManifests(mpath string) ([]orphanManifest, error) {
+	b, err := ioutil.ReadFile(mpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []orphanManifest
+	if err := json.Unmarshal(b, &ms); err == nil {
+		return ms, nil
+	}
+
+	var m orphanManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, xerrors.Errorf("decoding manifest: %w", err)
+	}
+	return []orphanManifest{m}, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/docker/go-units"
+	"github.com/elastic/go-sysinfo"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"sync"
+)
+
+var (
+	parallelFlag = &cli.IntFlag{
+		Name:  "parallel",
+		Usage: "number of partitions to prove at the same time, as far as --memory allows",
+		Value: 1,
+	}
+	memoryFlag = &cli.StringFlag{
+		Name:  "memory",
+		Usage: "memory the partitions proven at the same time may use, ps: 256GiB. By default the available memory of the host",
+	}
+	partitionMemoryFlag = &cli.StringFlag{
+		Name:  "partition-memory",
+		Usage: "memory needed to prove a full partition, ps: 96GiB, instead of the estimate from the sector size",
+	}
+)
+
+// partitionLimits bounds the partitions proven at the same time by their
+// number and by their estimated memory.
+type partitionLimits struct {
+	parallel int
+	memory   uint64
+	// memory of a full partition, 0 to estimate it
+	fullPartition uint64
+}
+
+// getPartitionLimits reads --parallel, --memory and --partition-memory. It
+// returns nil when partitions are proven one at a time.
+func getPartitionLimits(cctx *cli.Context) (*partitionLimits, error) {
+	parallel := cctx.Int(parallelFlag.Name)
+	if parallel < 1 {
+		return nil, xerrors.New("--parallel must be at least 1")
+	}
+	if parallel == 1 {
+		return nil, nil
+	}
+	if cctx.Bool("batch") {
+		return nil, xerrors.New("--parallel proves partitions, it doesn't apply to --batch")
+	}
+
+	lim := &partitionLimits{parallel: parallel}
+
+	if s := cctx.String(memoryFlag.Name); s != "" {
+		m, err := units.RAMInBytes(s)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing --memory: %w", err)
+		}
+		lim.memory = uint64(m)
+	} else {
+		h, err := sysinfo.Host()
+		if err != nil {
+			return nil, xerrors.Errorf("getting host info: %w", err)
+		}
+		mem, err := h.Memory()
+		if err != nil {
+			return nil, xerrors.Errorf("getting host memory: %w", err)
+		}
+		lim.memory = mem.Available
+	}
+
+	if s := cctx.String(partitionMemoryFlag.Name); s != "" {
+		m, err := units.RAMInBytes(s)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing --partition-memory: %w", err)
+		}
+		lim.fullPartition = uint64(m)
+	}
+
+	log.Infow("proving partitions in parallel", "parallel", lim.parallel, "memory", types.SizeStr(types.NewInt(lim.memory)))
+	return lim, nil
+}
+
+// partitionMemory estimates the memory needed to prove a partition with the
+// number of sectors. It is a rough figure: the parameters and the base of
+// the proof take about one sector size, the vanilla proofs grow with the
+// challenged sectors up to two more sector sizes for a full partition.
+func (l *partitionLimits) partitionMemory(pp abi.RegisteredPoStProof, sectors uint64) (uint64, error) {
+	ssize, err := pp.SectorSize()
+	if err != nil {
+		return 0, err
+	}
+	full, err := pp.WindowPoStPartitionSectors()
+	if err != nil {
+		return 0, err
+	}
+
+	if l.fullPartition != 0 {
+		return l.fullPartition * sectors / full, nil
+	}
+	return uint64(ssize) + 2*uint64(ssize)*sectors/full, nil
+}
+
+// memoryBudget hands out memory to the partitions being proven, in the order
+// they ask for it.
+type memoryBudget struct {
+	lk   sync.Mutex
+	cond *sync.Cond
+	free uint64
+}
+
+func newMemoryBudget(total uint64) *memoryBudget {
+	b := &memoryBudget{free: total}
+	b.cond = sync.NewCond(&b.lk)
+	return b
+}
+
+func (b *memoryBudget) acquire(n uint64) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	for b.free < n {
+		b.cond.Wait()
+	}
+	b.free -= n
+}
+
+func (b *memoryBudget) release(n uint64) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.free += n
+	b.cond.Broadcast()
+}
+
+// emulatePartitions simulates the partitions of the deadline like
+// emulateDeadline, up to lim.parallel at a time and as many as the memory
+// estimate allows. All partitions share the provider and its index. Each
+// one is reported into its own report, which are added to rep in partition
+// order once all are done.
+func emulatePartitions(src sectorSource, p *util.Provider, parts []bitfield.BitField, deadlineID int, set string, lim *partitionLimits, rep *report) error {
+	maddr := src.actor()
+
+	pp, err := src.postProof()
+	if err != nil {
+		return err
+	}
+
+	budget := newMemoryBudget(lim.memory)
+	throttle := make(chan struct{}, lim.parallel)
+
+	// partitions already started are waited for if a later one can't start
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	reps := make([]*report, len(parts))
+	errs := make([]error, len(parts))
+	for idx, sectors := range parts {
+		n, err := sectors.Count()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Infow("no sectors to simulate in the partition", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "set", set)
+			continue
+		}
+
+		mem, err := lim.partitionMemory(pp, n)
+		if err != nil {
+			return err
+		}
+		if mem > lim.memory {
+			log.Warnw("partition needs more than --memory, proving it alone", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx,
+				"estimate", types.SizeStr(types.NewInt(mem)), "memory", types.SizeStr(types.NewInt(lim.memory)))
+			mem = lim.memory
+		}
+
+		// partitions start in order, the next waits until the memory is free
+		throttle <- struct{}{}
+		budget.acquire(mem)
+
+		log.Infow("simulating partition", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "sectors", n, "memory", types.SizeStr(types.NewInt(mem)))
+
+		reps[idx] = &report{}
+		wg.Add(1)
+		go func(idx int, sectors bitfield.BitField, mem uint64) {
+			defer wg.Done()
+			defer func() {
+				budget.release(mem)
+				<-throttle
+			}()
+
+			errs[idx] = emulateSectors(src, p, deadlineID, idx, sectors, nil, reps[idx])
+		}(idx, sectors, mem)
+	}
+	wg.Wait()
+
+	for idx, r := range reps {
+		if r == nil {
+			continue
+		}
+		if errs[idx] != nil {
+			return errs[idx]
+		}
+
+		rep.Partitions = append(rep.Partitions, r.Partitions...)
+		rep.Sectors = append(rep.Sectors, r.Sectors...)
+
+		if pr := r.Partitions[len(r.Partitions)-1]; pr.Status != statusOK {
+			log.Warnw("wdpost emulator err", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "status", pr.Status, "err", pr.Error)
+			continue
+		}
+
+		log.Infow("wdpost simulation is successful", "miner", maddr, "deadlineID", deadlineID, "partitionID", idx, "sids", rep.okSectors(maddr.String(), deadlineID, idx))
+	}
+
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
+	"github.com/ipfs/go-cid"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	statusOK      = "ok"
+	statusFaulty  = "faulty"
+	statusSkipped = "skipped"
+	statusFailed  = "failed"
+	// the sector is not in the on-chain sectors array, a stand-in was proven
+	statusSubstitute = "substitute"
+)
+
+var outputFlag = &cli.StringFlag{
+	Name:  "output",
+	Usage: "output format of the simulation results: json, csv or table",
+	Value: "table",
+}
+
+type sectorRecord struct {
+	Miner     string `json:"miner"`
+	Deadline  int    `json:"deadline"`
+	Partition int    `json:"partition"`
+	Sector    uint64 `json:"sector"`
+	Status    string `json:"status"`
+	SealedDir string `json:"sealed_dir"`
+	CacheDir  string `json:"cache_dir"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type partitionRecord struct {
+	Miner     string `json:"miner"`
+	Deadline  int    `json:"deadline"`
+	Partition int    `json:"partition"`
+	// all partitions proven together with --batch, starting with Partition
+	Batch       []int  `json:"batch,omitempty"`
+	Sectors     int    `json:"sectors"`
+	Substitutes int    `json:"substitutes"`
+	Faulty      int    `json:"faulty"`
+	Skipped     int    `json:"skipped"`
+	Status      string `json:"status"`
+	AcquireMs   int64  `json:"acquire_ms"`
+	GenerateMs  int64  `json:"generate_ms"`
+	// generation time of the first proof, GenerateMs also counts the proofs
+	// generated again without the faulty and skipped sectors
+	FirstGenerateMs int64  `json:"first_generate_ms"`
+	VerifyMs        int64  `json:"verify_ms"`
+	Error           string `json:"error,omitempty"`
+}
+
+// actorRecord sums up the records of one miner.
+type actorRecord struct {
+	Miner string `json:"miner"`
+	// height and tipset of the chain the sectors were read at
+	Epoch       abi.ChainEpoch `json:"epoch"`
+	Tipset      []cid.Cid      `json:"tipset,omitempty"`
+	Partitions  int            `json:"partitions"`
+	Failed      int            `json:"failed"`
+	Sectors     int            `json:"sectors"`
+	OK          int            `json:"ok"`
+	Faulty      int            `json:"faulty"`
+	Skipped     int            `json:"skipped"`
+	Substitutes int            `json:"substitutes"`
+}
+
+type report struct {
+	Actors     []actorRecord     `json:"actors"`
+	Partitions []partitionRecord `json:"partitions"`
+	Sectors    []sectorRecord    `json:"sectors"`
+}
+
+type emulationResult struct {
+	Faulty   []abi.SectorID
+	Skipped  []abi.SectorID
+	Verified bool
+	// part of Generate spent finding the sector files
+	Acquire  time.Duration
+	Generate time.Duration
+	// part of Generate spent on the first proof, before proving again
+	// without the faulty and skipped sectors
+	FirstGenerate time.Duration
+	Verify        time.Duration
+}
+
+func checkOutputFormat(cctx *cli.Context) error {
+	switch cctx.String("output") {
+	case "json", "csv", "table":
+		return nil
+	default:
+		return xerrors.Errorf("unknown --output format: %s", cctx.String("output"))
+	}
+}
+
+// addActor starts the records of a miner whose sectors were read at the
+// tipset.
+func (r *report) addActor(maddr addr.Address, epoch abi.ChainEpoch, tsk types.TipSetKey) {
+	r.Actors = append(r.Actors, actorRecord{Miner: maddr.String(), Epoch: epoch, Tipset: tsk.Cids()})
+}
+
+// epoch returns the height the sectors of the miner were read at.
+func (r *report) epoch(miner string) abi.ChainEpoch {
+	for _, a := range r.Actors {
+		if a.Miner == miner {
+			return a.Epoch
+		}
+	}
+	return 0
+}
+
+// summarize counts the records of each miner into Actors.
+func (r *report) summarize() {
+	byMiner := map[string]*actorRecord{}
+	for i := range r.Actors {
+		a := &r.Actors[i]
+		*a = actorRecord{Miner: a.Miner, Epoch: a.Epoch, Tipset: a.Tipset}
+		byMiner[a.Miner] = a
+	}
+
+	actor := func(miner string) *actorRecord {
+		if a, ok := byMiner[miner]; ok {
+			return a
+		}
+		r.Actors = append(r.Actors, actorRecord{Miner: miner})
+		// the append may have moved the others
+		for i := range r.Actors {
+			byMiner[r.Actors[i].Miner] = &r.Actors[i]
+		}
+		return byMiner[miner]
+	}
+
+	for _, p := range r.Partitions {
+		a := actor(p.Miner)
+		a.Partitions++
+		if p.Status != statusOK {
+			a.Failed++
+		}
+	}
+
+	for _, s := range r.Sectors {
+		a := actor(s.Miner)
+		a.Sectors++
+		switch s.Status {
+		case statusOK:
+			a.OK++
+		case statusFaulty:
+			a.Faulty++
+		case statusSkipped:
+			a.Skipped++
+		case statusSubstitute:
+			a.Substitutes++
+		}
+	}
+}
+
+// add records the outcome of one simulated proof. The deadline and partition
+// are -1 when the sectors were not selected by partition. issues holds the
+// reason why a sector is not live on chain, if known.
+func (r *report) add(p *util.Provider, maddr addr.Address, dlIdx, partIdx int, sInfo []proof.SectorInfo, substitutes []abi.SectorNumber, issues map[abi.SectorNumber]string, res *emulationResult, err error) {
+	mid, _ := addr.IDFromAddress(maddr)
+
+	pr := partitionRecord{
+		Miner:       maddr.String(),
+		Deadline:    dlIdx,
+		Partition:   partIdx,
+		Sectors:     len(sInfo),
+		Substitutes: len(substitutes),
+		Status:      statusOK,
+	}
+
+	faulty := map[abi.SectorNumber]struct{}{}
+	skipped := map[abi.SectorNumber]struct{}{}
+	if res != nil {
+		for _, s := range res.Faulty {
+			faulty[s.Number] = struct{}{}
+		}
+		for _, s := range res.Skipped {
+			skipped[s.Number] = struct{}{}
+		}
+		pr.Faulty = len(faulty)
+		pr.Skipped = len(skipped)
+		pr.AcquireMs = res.Acquire.Milliseconds()
+		pr.GenerateMs = res.Generate.Milliseconds()
+		pr.FirstGenerateMs = res.FirstGenerate.Milliseconds()
+		pr.VerifyMs = res.Verify.Milliseconds()
+	}
+
+	switch {
+	case err != nil:
+		pr.Status = statusFailed
+		pr.Error = err.Error()
+	case !res.Verified:
+		pr.Status = statusFailed
+		pr.Error = "window post verification failed"
+	case len(faulty) != 0:
+		pr.Status = statusFaulty
+	case len(skipped) != 0:
+		pr.Status = statusSkipped
+	}
+	r.Partitions = append(r.Partitions, pr)
+
+	recorded := map[abi.SectorNumber]struct{}{}
+	for _, s := range sInfo {
+		// stand-ins of substitutes repeat a sector which is already recorded
+		if _, ok := recorded[s.SectorNumber]; ok {
+			continue
+		}
+		recorded[s.SectorNumber] = struct{}{}
+
+		sr := sectorRecord{
+			Miner:     pr.Miner,
+			Deadline:  dlIdx,
+			Partition: partIdx,
+			Sector:    uint64(s.SectorNumber),
+			Status:    statusOK,
+			ElapsedMs: pr.GenerateMs + pr.VerifyMs,
+			Reason:    issues[s.SectorNumber],
+		}
+
+		if loc, ok := p.Location(abi.SectorID{Miner: abi.ActorID(mid), Number: s.SectorNumber}); ok {
+			sr.SealedDir = loc.SealedRoot
+			sr.CacheDir = loc.CacheRoot
+		}
+
+		if _, ok := faulty[s.SectorNumber]; ok {
+			sr.Status = statusFaulty
+		} else if _, ok := skipped[s.SectorNumber]; ok {
+			sr.Status = statusSkipped
+		} else if pr.Status == statusFailed {
+			sr.Status = statusFailed
+		}
+
+		r.Sectors = append(r.Sectors, sr)
+	}
+
+	for _, s := range substitutes {
+		reason, ok := issues[s]
+		if !ok {
+			reason = "not found on chain"
+		}
+
+		r.Sectors = append(r.Sectors, sectorRecord{
+			Miner:     pr.Miner,
+			Deadline:  dlIdx,
+			Partition: partIdx,
+			Sector:    uint64(s),
+			Status:    statusSubstitute,
+			Reason:    reason,
+		})
+	}
+}
+
+// okSectors returns the sectors of the partition of the miner which were
+// proven and are live on chain.
+func (r *report) okSectors(miner string, dlIdx, partIdx int) []uint64 {
+	var out []uint64
+	for _, s := range r.Sectors {
+		if s.Miner == miner && s.Deadline == dlIdx && s.Partition == partIdx && s.Status == statusOK && s.Reason == "" {
+			out = append(out, s.Sector)
+		}
+	}
+	return out
+}
+
+func (r *report) failed() int {
+	n := 0
+	for _, p := range r.Partitions {
+		if p.Status != statusOK {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *report) print(cctx *cli.Context) error {
+	return r.write(os.Stdout, cctx.String("output"))
+}
+
+func (r *report) write(w io.Writer, format string) error {
+	r.summarize()
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		return r.writeCSV(w)
+	case "table":
+		return r.writeTable(w)
+	default:
+		return xerrors.Errorf("unknown output format: %s", format)
+	}
+}
+
+func (r *report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"record", "miner", "deadline", "partition", "sector", "status", "sealed_dir", "cache_dir", "sectors", "substitutes", "faulty", "skipped", "acquire_ms", "generate_ms", "verify_ms", "elapsed_ms", "detail"}); err != nil {
+		return err
+	}
+
+	for _, p := range r.Partitions {
+		if err := cw.Write([]string{"partition", p.Miner, strconv.Itoa(p.Deadline), strconv.Itoa(p.Partition), "", p.Status, "", "",
+			strconv.Itoa(p.Sectors), strconv.Itoa(p.Substitutes), strconv.Itoa(p.Faulty), strconv.Itoa(p.Skipped),
+			strconv.FormatInt(p.AcquireMs, 10), strconv.FormatInt(p.GenerateMs, 10), strconv.FormatInt(p.VerifyMs, 10), "", p.Error}); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range r.Sectors {
+		if err := cw.Write([]string{"sector", s.Miner, strconv.Itoa(s.Deadline), strconv.Itoa(s.Partition), strconv.FormatUint(s.Sector, 10), s.Status, s.SealedDir, s.CacheDir,
+			"", "", "", "", "", "", "", strconv.FormatInt(s.ElapsedMs, 10), s.Reason}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *report) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "MINER\tDEADLINE\tPARTITION\tSECTORS\tSUBSTITUTES\tFAULTY\tSKIPPED\tSTATUS\tACQUIRE\tGENERATE\tVERIFY\tERROR")
+	for _, p := range r.Partitions {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", p.Miner, p.Deadline, p.Partition, p.Sectors, p.Substitutes, p.Faulty, p.Skipped, p.Status,
+			time.Duration(p.AcquireMs)*time.Millisecond, time.Duration(p.GenerateMs)*time.Millisecond, time.Duration(p.VerifyMs)*time.Millisecond, p.Error)
+	}
+	_, _ = fmt.Fprintln(tw)
+
+	_, _ = fmt.Fprintln(tw, "MINER\tDEADLINE\tPARTITION\tSECTOR\tSTATUS\tSEALED DIR\tCACHE DIR\tREASON")
+	for _, s := range r.Sectors {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", s.Miner, s.Deadline, s.Partition, s.Sector, s.Status, s.SealedDir, s.CacheDir, s.Reason)
+	}
+	_, _ = fmt.Fprintln(tw)
+
+	_, _ = fmt.Fprintln(tw, "MINER\tEPOCH\tTIPSET\tPARTITIONS\tFAILED\tSECTORS\tOK\tFAULTY\tSKIPPED\tSUBSTITUTES")
+	for _, a := range r.Actors {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", a.Miner, a.Epoch, types.NewTipSetKey(a.Tipset...), a.Partitions, a.Failed, a.Sectors, a.OK, a.Faulty, a.Skipped, a.Substitutes)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"strings"
+)
+
+var offlineFlag = &cli.StringFlag{
+	Name:  "offline",
+	Usage: "run without a full node, reading the sectors from manifests written by the export command, separate commas",
+}
+
+// sectorSource provides the emulators with the on-chain data of the sectors,
+// read from a full node or from an exported manifest.
+type sectorSource interface {
+	// partitions returns the sectors of the set in each partition of the
+	// deadline, by partition index
+	partitions(deadlineID int, set string) ([]bitfield.BitField, error)
+	// sectorInfo returns the proof infos of the sectors, see getSectorInfo
+	sectorInfo(sectors bitfield.BitField) ([]proof.SectorInfo, []abi.SectorNumber, error)
+	// explain returns why sectors are not live, see explainSectors
+	explain(sectors bitfield.BitField) (map[abi.SectorNumber]string, error)
+	partitionsPerMessage() (int, error)
+	// postProof returns the WindowPoSt proof type of the miner
+	postProof() (abi.RegisteredPoStProof, error)
+	// tipset returns the height and the tipset the sectors are read at
+	tipset() (abi.ChainEpoch, types.TipSetKey)
+	// attach lets the provider find the sectors upgraded with SnapDeals
+	attach(p *util.Provider) *util.Provider
+	actor() addr.Address
+}
+
+type chainSource struct {
+	api   api.FullNode
+	maddr addr.Address
+	ts    *types.TipSet
+}
+
+func (s *chainSource) partitions(deadlineID int, set string) ([]bitfield.BitField, error) {
+	mas, err := loadMinerState(s.api, s.maddr, s.ts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	dl, err := mas.LoadDeadline(uint64(deadlineID))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []bitfield.BitField
+	err = dl.ForEachPartition(func(_ uint64, part miner.Partition) error {
+		sectors, err := partitionSectors(part, set)
+		if err != nil {
+			return err
+		}
+		out = append(out, sectors)
+		return nil
+	})
+	return out, err
+}
+
+func (s *chainSource) sectorInfo(sectors bitfield.BitField) ([]proof.SectorInfo, []abi.SectorNumber, error) {
+	return getSectorInfo(s.api, s.maddr, sectors, s.ts.Key())
+}
+
+func (s *chainSource) explain(sectors bitfield.BitField) (map[abi.SectorNumber]string, error) {
+	return explainSectors(s.api, s.maddr, sectors, s.ts)
+}
+
+func (s *chainSource) partitionsPerMessage() (int, error) {
+	return maxPartitionsPerMessage(s.api, s.maddr, s.ts.Key())
+}
+
+func (s *chainSource) postProof() (abi.RegisteredPoStProof, error) {
+	mi, err := s.api.StateMinerInfo(context.Background(), s.maddr, s.ts.Key())
+	if err != nil {
+		return 0, xerrors.Errorf("getting miner info: %w", err)
+	}
+	return mi.WindowPoStProofType, nil
+}
+
+func (s *chainSource) tipset() (abi.ChainEpoch, types.TipSetKey) {
+	return s.ts.Height(), s.ts.Key()
+}
+
+func (s *chainSource) attach(p *util.Provider) *util.Provider {
+	return p.UseChain(s.api, s.ts.Key())
+}
+
+func (s *chainSource) actor() addr.Address {
+	return s.maddr
+}
+
+// getSectorSources returns a source per actor: the manifests of --offline,
+// separated by commas, or the actors of --actor read from the full node at
+// the tipset of getTipSet. Offline, --actor only picks among the manifests.
+func getSectorSources(cctx *cli.Context) ([]sectorSource, func(), error) {
+	if cctx.String("offline") != "" {
+		if cctx.IsSet(util.TipSetFlag.Name) || cctx.IsSet(util.HeightFlag.Name) {
+			return nil, nil, xerrors.New("--tipset and --height need a full node, a manifest is read at the tipset it was exported at")
+		}
+
+		var actors map[addr.Address]struct{}
+		if cctx.IsSet("actor") {
+			maddrs, err := util.GetActorAddresses(cctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			actors = map[addr.Address]struct{}{}
+			for _, maddr := range maddrs {
+				actors[maddr] = struct{}{}
+			}
+		}
+
+		var out []sectorSource
+		for _, mpath := range strings.Split(cctx.String("offline"), ",") {
+			m, err := loadSectorManifest(mpath)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			src, err := newManifestSource(m)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("manifest %s: %w", mpath, err)
+			}
+			if _, ok := actors[src.actor()]; actors != nil && !ok {
+				continue
+			}
+			delete(actors, src.actor())
+
+			log.Infow("running offline", "manifest", mpath, "miner", m.Miner, "height", m.Height, "sectors", len(m.Sectors))
+			out = append(out, src)
+		}
+
+		for maddr := range actors {
+			return nil, nil, xerrors.Errorf("no manifest for miner %s", maddr)
+		}
+		if len(out) == 0 {
+			return nil, nil, xerrors.New("no manifest selected")
+		}
+
+		return out, func() {}, nil
+	}
+
+	nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maddrs, err := util.GetActorAddresses(cctx)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	ts, err := util.GetTipSet(lcli.ReqContext(cctx), cctx, nodeApi)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	out := make([]sectorSource, 0, len(maddrs))
+	for _, maddr := range maddrs {
+		out = append(out, &chainSource{api: nodeApi, maddr: maddr, ts: ts})
+	}
+
+	return out, closer, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+	"time"
+)
+
+var watchCmd = &cli.Command{
+	Name:  "watch",
+	Usage: "follow the chain and simulate the WindowPost of each deadline before it opens",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		&cli.Int64Flag{
+			Name:  "lead",
+			Usage: "number of epochs before a deadline opens to start its simulation",
+			Value: 20,
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "serve sector health metrics for prometheus on this address, ps: 0.0.0.0:9110",
+		},
+		sectorSetFlag,
+		batchFlag,
+		parallelFlag,
+		memoryFlag,
+		partitionMemoryFlag,
+		historyRepoFlag,
+		outputFlag,
+		alertWebhookFlag,
+		alertExecFlag,
+		alertFileFlag,
+		alertStateFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		if err := checkOutputFormat(cctx); err != nil {
+			return err
+		}
+
+		if err := checkSectorSet(cctx); err != nil {
+			return err
+		}
+
+		lim, err := getPartitionLimits(cctx)
+		if err != nil {
+			return err
+		}
+
+		lead := cctx.Int64("lead")
+		// a deadline is rehearsed once the lead reaches its open epoch, with
+		// no lead it would only be reached once the deadline is current
+		if lead < 1 {
+			return xerrors.New("--lead must be at least 1")
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		w := &watchdog{
+			api:      nodeApi,
+			maddrs:   maddrs,
+			lastOpen: map[addr.Address]abi.ChainEpoch{},
+			paths:    paths,
+			lead:     abi.ChainEpoch(lead),
+			set:      cctx.String("set"),
+			batch:    cctx.Bool("batch"),
+			limits:   lim,
+			history:  cctx.String(historyRepoFlag.Name),
+			output:   cctx.String("output"),
+		}
+
+		w.alerts, err = newAlerter(cctx)
+		if err != nil {
+			return err
+		}
+
+		if listen := cctx.String("metrics-listen"); listen != "" {
+			w.health = newSectorHealth()
+			w.health.serve(listen)
+		}
+
+		return w.run(lcli.ReqContext(cctx))
+	},
+}
+
+type watchdog struct {
+	api     api.FullNode
+	maddrs  []addr.Address
+	paths   []util.StoragePath
+	lead    abi.ChainEpoch
+	set     string
+	batch   bool
+	limits  *partitionLimits
+	history string
+	output  string
+	health  *sectorHealth
+	alerts  *alerter
+
+	// open epoch of the last rehearsed deadline of each miner
+	lastOpen map[addr.Address]abi.ChainEpoch
+}
+
+func (w *watchdog) run(ctx context.Context) error {
+	log.Infow("wdpost watchdog started", "actors", w.maddrs, "lead", w.lead)
+
+	tick := time.NewTicker(time.Duration(build.BlockDelaySecs) * time.Second)
+	defer tick.Stop()
+
+	for {
+		if err := w.check(ctx); err != nil {
+			log.Errorw("wdpost watchdog check failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// check simulates, for each miner, the deadline that opens within the lead
+// window, unless it has already been simulated. Miners whose deadlines are
+// due at the same time share the index of the storage paths.
+func (w *watchdog) check(ctx context.Context) error {
+	head, err := w.api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the index is only built if a deadline is due
+	p := util.NewProviderFromPaths(w.paths).UseChain(w.api, head.Key())
+
+	for _, maddr := range w.maddrs {
+		if err := w.checkActor(ctx, head, maddr, p); err != nil {
+			log.Errorw("wdpost watchdog check failed", "miner", maddr, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *watchdog) checkActor(ctx context.Context, head *types.TipSet, maddr addr.Address, p *util.Provider) error {
+	di, err := w.api.StateMinerProvingDeadline(ctx, maddr, head.Key())
+	if err != nil {
+		return xerrors.Errorf("getting proving deadline: %w", err)
+	}
+
+	// number of deadlines between the current one and the one the lead window reaches
+	k := (head.Height() + w.lead - di.Open) / di.WPoStChallengeWindow
+	if k < 1 {
+		return nil
+	}
+
+	open := di.Open + k*di.WPoStChallengeWindow
+	if open <= w.lastOpen[maddr] {
+		return nil
+	}
+	w.lastOpen[maddr] = open
+
+	dlIdx := (di.Index + uint64(k)) % di.WPoStPeriodDeadlines
+	log.Infow("simulating deadline before it opens", "miner", maddr, "deadline", dlIdx, "open", open, "height", head.Height())
+
+	var rep report
+	rep.addActor(maddr, head.Height(), head.Key())
+	if err := emulateDeadline(&chainSource{api: w.api, maddr: maddr, ts: head}, p, int(dlIdx), w.set, w.batch, w.limits, &rep); err != nil {
+		return xerrors.Errorf("simulating deadline %d: %w", dlIdx, err)
+	}
+
+	if len(rep.Partitions) == 0 {
+		log.Infow("deadline has no partitions", "miner", maddr, "deadline", dlIdx)
+		return nil
+	}
+
+	if err := rep.write(os.Stdout, w.output); err != nil {
+		return err
+	}
+
+	recordHistory(ctx, w.history, &rep)
+
+	if w.health != nil {
+		w.health.record(&rep)
+	}
+
+	w.alert(maddr, dlIdx, open, &rep)
+
+	if w.alerts != nil {
+		if err := w.alerts.process(ctx, &rep); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *watchdog) alert(maddr addr.Address, dlIdx uint64, open abi.ChainEpoch, rep *report) {
+	var failed []uint64
+	for _, s := range rep.Sectors {
+		if s.Status != statusOK {
+			failed = append(failed, s.Sector)
+		}
+	}
+
+	if len(failed) == 0 && rep.failed() == 0 {
+		log.Infow("deadline simulation is successful", "miner", maddr, "deadline", dlIdx, "open", open)
+		return
+	}
+
+	log.Errorw("sectors would fail the WindowPost of the deadline", "miner", maddr, "deadline", dlIdx, "open", open, "failedPartitions", rep.failed(), "sectors", failed)
+}
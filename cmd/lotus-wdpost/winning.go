@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/extern/sector-storage/ffiwrapper"
+	"github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
+	"github.com/luluup777/lotus-box/util"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"sort"
+	"time"
+)
+
+var winningEmulator = &cli.Command{
+	Name:  "w-emulator",
+	Usage: "WinningPost simulator",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "sdir",
+			Usage: "the directory where the sector is stored, if there are more than one, separate commas",
+			Value: "",
+		},
+		minerRepoFlag,
+		fromMinerFlag,
+		withSealFlag,
+		&cli.StringFlag{
+			Name:  "actor",
+			Usage: "miner actor ids, if there are more than one, separate commas",
+		},
+		util.TipSetFlag,
+		util.HeightFlag,
+		historyRepoFlag,
+		outputFlag,
+		metricsPushFlag,
+		alertWebhookFlag,
+		alertExecFlag,
+		alertFileFlag,
+		alertStateFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		if err := checkOutputFormat(cctx); err != nil {
+			return err
+		}
+
+		nodeApi, closer, err := lcli.GetFullNodeAPIV1(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ctx := lcli.ReqContext(cctx)
+
+		maddrs, err := util.GetActorAddresses(cctx)
+		if err != nil {
+			return err
+		}
+
+		paths, err := getStoragePaths(cctx)
+		if err != nil {
+			return err
+		}
+
+		ts, err := util.GetTipSet(ctx, cctx, nodeApi)
+		if err != nil {
+			return err
+		}
+		pinned := cctx.IsSet(util.TipSetFlag.Name) || cctx.IsSet(util.HeightFlag.Name)
+
+		p := util.NewProviderFromPaths(paths).UseChain(nodeApi, ts.Key())
+
+		var rep report
+		for _, maddr := range maddrs {
+			// the challenge of each miner is drawn with its own address
+			var randomness abi.PoStRandomness
+			if pinned {
+				// the challenge the miner would have drawn from the beacon
+				// of the tipset, else a random one
+				buf := new(bytes.Buffer)
+				if err := maddr.MarshalCBOR(buf); err != nil {
+					return err
+				}
+				r, err := nodeApi.StateGetRandomnessFromBeacon(ctx, crypto.DomainSeparationTag_WinningPoStChallengeSeed, ts.Height(), buf.Bytes(), ts.Key())
+				if err != nil {
+					return xerrors.Errorf("getting randomness: %w", err)
+				}
+				randomness = abi.PoStRandomness(r)
+			} else {
+				randomness = make(abi.PoStRandomness, 32)
+				_, _ = rand.Read(randomness)
+			}
+
+			rep.addActor(maddr, ts.Height(), ts.Key())
+			if err := emulateWinning(ctx, nodeApi, p, maddr, ts, randomness, &rep); err != nil {
+				return xerrors.Errorf("miner %s: %w", maddr, err)
+			}
+		}
+
+		return finishReport(cctx, &rep)
+	},
+}
+
+// emulateWinning selects the sectors challenged by the randomness among the
+// active sectors at ts, proves and verifies them, and compares the time taken
+// with the time a miner has to produce a block.
+func emulateWinning(ctx context.Context, nodeApi api.FullNode, p *util.Provider, maddr addr.Address, ts *types.TipSet, randomness abi.PoStRandomness, rep *report) error {
+	mid, err := addr.IDFromAddress(maddr)
+	if err != nil {
+		return err
+	}
+
+	sectors, err := nodeApi.StateMinerActiveSectors(ctx, maddr, ts.Key())
+	if err != nil {
+		return xerrors.Errorf("getting active sectors: %w", err)
+	}
+	if len(sectors) == 0 {
+		return xerrors.New("the miner has no active sectors")
+	}
+	sort.Slice(sectors, func(i, j int) bool {
+		return sectors[i].SectorNumber < sectors[j].SectorNumber
+	})
+
+	mi, err := nodeApi.StateMinerInfo(ctx, maddr, ts.Key())
+	if err != nil {
+		return xerrors.Errorf("getting miner info: %w", err)
+	}
+	nv, err := nodeApi.StateNetworkVersion(ctx, ts.Key())
+	if err != nil {
+		return xerrors.Errorf("getting network version: %w", err)
+	}
+	spt, err := miner.PreferredSealProofTypeFromWindowPoStType(nv, mi.WindowPoStProofType)
+	if err != nil {
+		return err
+	}
+	wpt, err := spt.RegisteredWinningPoStProof()
+	if err != nil {
+		return err
+	}
+
+	ids, err := ffiwrapper.ProofVerifier.GenerateWinningPoStSectorChallenge(ctx, wpt, abi.ActorID(mid), randomness, uint64(len(sectors)))
+	if err != nil {
+		return xerrors.Errorf("generating sector challenge: %w", err)
+	}
+
+	sInfo := make([]proof.SectorInfo, 0, len(ids))
+	for _, id := range ids {
+		s := sectors[id]
+		sInfo = append(sInfo, proof.SectorInfo{
+			SealProof:    s.SealProof,
+			SectorNumber: s.SectorNumber,
+			SealedCID:    s.SealedCID,
+		})
+	}
+	log.Infow("sectors challenged", "miner", maddr, "height", ts.Height(), "active", len(sectors), "sectors", ids)
+
+	res := &emulationResult{}
+	start := time.Now()
+	proofs, skipped, err := p.GenerateWinningPoSt(ctx, abi.ActorID(mid), sInfo, randomness)
+	res.Generate = time.Since(start)
+	res.Skipped = skipped
+
+	if err == nil {
+		start = time.Now()
+		var ok bool
+		ok, err = ffiwrapper.ProofVerifier.VerifyWinningPoSt(ctx, proof.WinningPoStVerifyInfo{
+			Randomness:        randomness,
+			Proofs:            proofs,
+			ChallengedSectors: sInfo,
+			Prover:            abi.ActorID(mid),
+		})
+		res.Verify = time.Since(start)
+		res.Verified = ok && err == nil
+	}
+
+	rep.add(p, maddr, -1, -1, sInfo, nil, nil, res, err)
+
+	// the block has to be out before the propagation cutoff
+	budget := time.Duration(build.BlockDelaySecs-build.PropagationDelaySecs) * time.Second
+	if res.Generate > budget {
+		log.Warnw("winning post is too slow to produce a block in time", "miner", maddr, "generate", res.Generate, "budget", budget)
+	} else {
+		log.Infow("winning post timing", "miner", maddr, "generate", res.Generate, "verify", res.Verify, "budget", budget)
+	}
+
+	return nil
+}
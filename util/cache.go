@@ -0,0 +1,187 @@
+package util
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/ipfs/go-cid"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CacheCheck is the result of the structural check of the cache directory and
+// sealed file of a sector. PAuxCommR is recomputed from p_aux as
+// poseidon(comm_c, comm_r_last); callers compare it with the on-chain CommR,
+// which tells a cache belonging to another replica.
+type CacheCheck struct {
+	Sector    abi.SectorID `json:"sector"`
+	CacheRoot string       `json:"cache_root"`
+	Sealed    string       `json:"sealed"`
+	CommC     string       `json:"comm_c,omitempty"`
+	CommRLast string       `json:"comm_r_last,omitempty"`
+	PAuxCommR string       `json:"p_aux_comm_r,omitempty"`
+	// CommR is the on-chain replica commitment, set by callers reading the
+	// chain along with the tipset it was read at
+	CommR  string         `json:"comm_r,omitempty"`
+	Height abi.ChainEpoch `json:"height,omitempty"`
+	Tipset []cid.Cid      `json:"tipset,omitempty"`
+	Issues []string       `json:"issues,omitempty"`
+}
+
+func (c *CacheCheck) issuef(format string, args ...interface{}) {
+	c.Issues = append(c.Issues, fmt.Sprintf(format, args...))
+}
+
+// treeRLastLayout returns the number of tree-r-last files of a sector and the
+// size of each, like the fault check of lotus expects them. A size of 0 means
+// the size is not checked, a count of 0 that the layout is not known.
+func treeRLastLayout(ssize abi.SectorSize) (int, int64) {
+	switch ssize {
+	case 2 << 10, 8 << 20, 512 << 20:
+		return 1, 0
+	case 32 << 30:
+		return 8, 9586976
+	case 64 << 30:
+		return 16, 9586976
+	default:
+		return 0, 0
+	}
+}
+
+// checkTAux decodes t_aux and checks that it names the trees of the sector.
+func (c *CacheCheck) checkTAux(cacheDir string) {
+	ta, err := ReadTAux(cacheDir)
+	if err != nil {
+		c.issuef("t_aux: %s", err)
+		return
+	}
+
+	if len(ta.Labels) == 0 {
+		c.issuef("t_aux has no labels")
+	}
+	for _, tc := range []struct {
+		sc StoreConfig
+		id string
+	}{{ta.TreeD, "tree-d"}, {ta.TreeRLast, "tree-r-last"}, {ta.TreeC, "tree-c"}} {
+		if tc.sc.ID != tc.id {
+			c.issuef("t_aux has %q where %s is expected", tc.sc.ID, tc.id)
+		}
+	}
+}
+
+// CheckCache checks that p_aux and t_aux exist and can be decoded, that the
+// tree-r-last files match the sector size, and that the sealed file has the
+// sector size. The CommR of p_aux is recomputed. The first root of each file
+// in the index is checked. For sectors upgraded with SnapDeals, the update
+// file and update-cache directory are checked instead, without t_aux.
+func CheckCache(idx *SectorIndex, sid abi.SectorID, ssize abi.SectorSize, updated bool) CacheCheck {
+	c := CacheCheck{Sector: sid}
+
+	sealedType, cacheType := storiface.FTSealed, storiface.FTCache
+	if updated {
+		sealedType, cacheType = storiface.FTUpdate, storiface.FTUpdateCache
+	}
+
+	sealedRoots := idx.Roots(sid, sealedType)
+	if len(sealedRoots) == 0 {
+		c.issuef("%s file not found", sealedType)
+	} else {
+		c.Sealed = idx.Path(sealedRoots[0], sid, sealedType)
+		if st, err := os.Stat(c.Sealed); err != nil {
+			c.issuef("stat %s file: %s", sealedType, err)
+		} else if st.Size() != int64(ssize) {
+			c.issuef("%s file has %d bytes, expected %d", sealedType, st.Size(), ssize)
+		}
+	}
+
+	cacheRoots := idx.Roots(sid, cacheType)
+	if len(cacheRoots) == 0 {
+		c.issuef("%s directory not found", cacheType)
+		return c
+	}
+	c.CacheRoot = cacheRoots[0]
+	cacheDir := idx.Path(c.CacheRoot, sid, cacheType)
+
+	if pa, err := ReadPAux(cacheDir); err != nil {
+		c.issuef("p_aux: %s", err)
+	} else {
+		c.CommC = hex.EncodeToString(pa.CommC[:])
+		c.CommRLast = hex.EncodeToString(pa.CommRLast[:])
+
+		if commR, err := pa.CommR(); err != nil {
+			c.issuef("p_aux: %s", err)
+		} else {
+			c.PAuxCommR = hex.EncodeToString(commR[:])
+		}
+	}
+
+	if !updated {
+		c.checkTAux(cacheDir)
+	}
+
+	count, size := treeRLastLayout(ssize)
+	if count == 0 {
+		log.Warnw("tree-r-last files of the sector size are not checked", "sector", sid, "size", ssize)
+	}
+	var names []string
+	switch {
+	case count == 1:
+		names = []string{"sc-02-data-tree-r-last.dat"}
+	case count > 1:
+		for i := 0; i < count; i++ {
+			names = append(names, fmt.Sprintf("sc-02-data-tree-r-last-%d.dat", i))
+		}
+	}
+
+	for _, name := range names {
+		st, err := os.Stat(filepath.Join(cacheDir, name))
+		if err != nil {
+			c.issuef("%s: %s", name, err)
+			continue
+		}
+		if size != 0 && st.Size() != size {
+			c.issuef("%s has %d bytes, expected %d", name, st.Size(), size)
+		}
+	}
+
+	return c
+}
+
+// CheckCaches runs CheckCache for the sectors, with one worker per storage
+// root so that every disk is read at the same time. Results are returned in
+// the order of sectors. updated holds the sectors upgraded with SnapDeals.
+func CheckCaches(idx *SectorIndex, sectors []abi.SectorID, ssize abi.SectorSize, updated map[abi.SectorID]bool) []CacheCheck {
+	out := make([]CacheCheck, len(sectors))
+
+	byRoot := map[string][]int{}
+	for i, sid := range sectors {
+		cacheType := storiface.FTCache
+		if updated[sid] {
+			cacheType = storiface.FTUpdateCache
+		}
+
+		root := ""
+		if roots := idx.Roots(sid, cacheType); len(roots) > 0 {
+			root = roots[0]
+		}
+		byRoot[root] = append(byRoot[root], i)
+	}
+
+	var wg sync.WaitGroup
+	for root, is := range byRoot {
+		wg.Add(1)
+		go func(root string, is []int) {
+			defer wg.Done()
+
+			for _, i := range is {
+				out[i] = CheckCache(idx, sectors[i], ssize, updated[sectors[i]])
+			}
+			log.Infow("cache check of storage path finished", "root", root, "sectors", len(is))
+		}(root, is)
+	}
+	wg.Wait()
+
+	return out
+}
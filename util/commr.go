@@ -0,0 +1,74 @@
+package util
+
+import (
+	"github.com/triplewz/poseidon"
+	ff "github.com/triplewz/poseidon/bls12_381"
+	"golang.org/x/xerrors"
+	"math/big"
+	"sync"
+)
+
+var (
+	commRConstsOnce sync.Once
+	commRConsts     *poseidon.PoseidonConst
+	commRConstsErr  error
+)
+
+// commRDomainTag is the domain tag neptune starts the state of a merkle tree
+// hash with, 2^arity-1.
+const commRDomainTag = 3
+
+// CommR computes the replica commitment from p_aux like the proofs do:
+// the Poseidon hash of arity 2 of comm_c and comm_r_last, the same as
+// neptune computes it. Commitments are field elements in little-endian.
+func (pa *PAux) CommR() ([32]byte, error) {
+	var out [32]byte
+
+	commRConstsOnce.Do(func() {
+		// the width is the arity plus the domain tag
+		var consts *poseidon.PoseidonConst
+		if consts, commRConstsErr = poseidon.GenPoseidonConstants(3); commRConstsErr == nil {
+			commRConsts = withDomainTag(consts, commRDomainTag)
+		}
+	})
+	if commRConstsErr != nil {
+		return out, xerrors.Errorf("generating poseidon constants: %w", commRConstsErr)
+	}
+
+	h, err := poseidon.Hash([]*big.Int{frToInt(pa.CommC), frToInt(pa.CommRLast)}, commRConsts, poseidon.OptimizedStatic)
+	if err != nil {
+		return out, xerrors.Errorf("hashing comm_c and comm_r_last: %w", err)
+	}
+
+	var be [32]byte
+	h.FillBytes(be[:])
+	for i := range be {
+		out[i] = be[31-i]
+	}
+	return out, nil
+}
+
+// withDomainTag returns the constants for a state starting with tag. The
+// library always starts the state with 0, and the first round constant is
+// only added to that element before the first round.
+func withDomainTag(c *poseidon.PoseidonConst, tag uint64) *poseidon.PoseidonConst {
+	tagged := *c
+	add := func(consts []*ff.Element) []*ff.Element {
+		out := append([]*ff.Element(nil), consts...)
+		t := new(ff.Element).SetUint64(tag)
+		out[0] = t.Add(t, consts[0])
+		return out
+	}
+	tagged.RoundConsts = add(c.RoundConsts)
+	tagged.ComRoundConts = add(c.ComRoundConts)
+	return &tagged
+}
+
+// frToInt reads a little-endian field element.
+func frToInt(fr [32]byte) *big.Int {
+	var be [32]byte
+	for i := range fr {
+		be[i] = fr[31-i]
+	}
+	return new(big.Int).SetBytes(be[:])
+}
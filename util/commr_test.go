@@ -0,0 +1,96 @@
+package util
+
+import (
+	"github.com/triplewz/poseidon"
+	"math/big"
+	"testing"
+)
+
+func TestFrToInt(t *testing.T) {
+	tests := []struct {
+		name string
+		fr   [32]byte
+		want *big.Int
+	}{
+		{name: "zero", want: big.NewInt(0)},
+		{name: "one", fr: [32]byte{0: 1}, want: big.NewInt(1)},
+		{name: "second byte", fr: [32]byte{1: 1}, want: big.NewInt(256)},
+		{name: "last byte", fr: [32]byte{31: 1}, want: new(big.Int).Lsh(big.NewInt(1), 248)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := frToInt(tc.fr); got.Cmp(tc.want) != 0 {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithDomainTag(t *testing.T) {
+	consts, err := poseidon.GenPoseidonConstants(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := consts.ComRoundConts[0].String()
+
+	tagged := withDomainTag(consts, commRDomainTag)
+	if consts.ComRoundConts[0].String() != first {
+		t.Fatal("the constants of the library were changed")
+	}
+
+	input := func() []*big.Int { return []*big.Int{big.NewInt(1), big.NewInt(2)} }
+
+	// the tag is folded into the first round constant, every mode of the
+	// library has to agree on it
+	var want *big.Int
+	for _, mode := range []poseidon.HashMode{poseidon.OptimizedStatic, poseidon.OptimizedDynamic, poseidon.Correct} {
+		h, err := poseidon.Hash(input(), tagged, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = h
+		} else if h.Cmp(want) != 0 {
+			t.Errorf("mode %d: got %s, want %s", mode, h.Text(16), want.Text(16))
+		}
+	}
+
+	untagged, err := poseidon.Hash(input(), consts, poseidon.OptimizedStatic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if untagged.Cmp(want) == 0 {
+		t.Error("the domain tag doesn't change the hash")
+	}
+}
+
+func TestCommR(t *testing.T) {
+	pa := PAux{CommC: [32]byte{0: 1}, CommRLast: [32]byte{0: 2}}
+
+	got, err := pa.CommR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consts, err := poseidon.GenPoseidonConstants(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := poseidon.Hash([]*big.Int{big.NewInt(1), big.NewInt(2)}, withDomainTag(consts, commRDomainTag), poseidon.Correct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frToInt(got).Cmp(h) != 0 {
+		t.Errorf("got %x, want %s in little-endian", got, h.Text(16))
+	}
+
+	swapped := PAux{CommC: pa.CommRLast, CommRLast: pa.CommC}
+	other, err := swapped.CommR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == got {
+		t.Error("comm_c and comm_r_last are hashed in no particular order")
+	}
+}
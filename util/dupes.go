@@ -0,0 +1,244 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PAux is the content of the p_aux file in a sector cache directory.
+type PAux struct {
+	CommC     [32]byte
+	CommRLast [32]byte
+}
+
+// ReadPAux reads the p_aux file of the cache directory.
+func ReadPAux(cacheDir string) (*PAux, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cacheDir, "p_aux"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != 64 {
+		return nil, xerrors.Errorf("p_aux of %s has %d bytes, expected 64", cacheDir, len(b))
+	}
+
+	var pa PAux
+	copy(pa.CommC[:], b[:32])
+	copy(pa.CommRLast[:], b[32:])
+	return &pa, nil
+}
+
+// SectorCopy is one file or cache directory of a sector in a storage root.
+type SectorCopy struct {
+	Root string `json:"root"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// hex encoded comm_c and comm_r_last from p_aux, cache copies only
+	PAux string `json:"p_aux,omitempty"`
+}
+
+// DuplicateSector lists the copies of a sector with more than one copy of a
+// file, or with files split between storage roots.
+type DuplicateSector struct {
+	Sector       abi.SectorID `json:"sector"`
+	Copies       []SectorCopy `json:"copies"`
+	Split        bool         `json:"split"`
+	SizeMismatch bool         `json:"size_mismatch"`
+	PAuxMismatch bool         `json:"p_aux_mismatch"`
+	Keep         string       `json:"keep"`
+	Reason       string       `json:"reason"`
+}
+
+// FindDuplicates inspects every sector of the index which has more than one
+// copy of a file, or files split between roots, and recommends a root to keep.
+func FindDuplicates(idx *SectorIndex) ([]DuplicateSector, error) {
+	var out []DuplicateSector
+	for _, sid := range idx.Duplicates() {
+		d, err := inspectDuplicate(idx, sid)
+		if err != nil {
+			return nil, xerrors.Errorf("inspecting sector %v: %w", sid, err)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func inspectDuplicate(idx *SectorIndex, sid abi.SectorID) (DuplicateSector, error) {
+	d := DuplicateSector{Sector: sid}
+
+	type rootState struct {
+		replica, cache bool
+		replicaSize    int64
+		paux           string
+	}
+	var order []string
+	roots := map[string]*rootState{}
+	state := func(root string) *rootState {
+		if _, ok := roots[root]; !ok {
+			roots[root] = &rootState{}
+			order = append(order, root)
+		}
+		return roots[root]
+	}
+
+	sizes := map[storiface.SectorFileType]map[int64]struct{}{}
+	pauxs := map[string]int{}
+
+	for _, ft := range indexedTypes {
+		sizes[ft] = map[int64]struct{}{}
+
+		for _, root := range idx.Roots(sid, ft) {
+			p := idx.Path(root, sid, ft)
+			size, err := PathSize(p)
+			if err != nil {
+				return d, err
+			}
+
+			c := SectorCopy{Root: root, Type: ft.String(), Size: size}
+			rs := state(root)
+
+			switch ft {
+			case storiface.FTSealed, storiface.FTUpdate:
+				rs.replica = true
+				rs.replicaSize = size
+				sizes[ft][size] = struct{}{}
+			case storiface.FTCache, storiface.FTUpdateCache:
+				rs.cache = true
+				if pa, err := ReadPAux(p); err == nil {
+					c.PAux = hex.EncodeToString(append(pa.CommC[:], pa.CommRLast[:]...))
+					if ft == storiface.FTCache {
+						rs.paux = c.PAux
+						pauxs[c.PAux]++
+					}
+				}
+			}
+
+			d.Copies = append(d.Copies, c)
+		}
+	}
+
+	for _, ft := range []storiface.SectorFileType{storiface.FTSealed, storiface.FTUpdate} {
+		if len(sizes[ft]) > 1 {
+			d.SizeMismatch = true
+		}
+	}
+	d.PAuxMismatch = len(pauxs) > 1
+
+	var maxSize int64
+	for _, rs := range roots {
+		if rs.replicaSize > maxSize {
+			maxSize = rs.replicaSize
+		}
+	}
+
+	// the most common p_aux is assumed to be the right one, unless another
+	// is as common
+	var commonPAux string
+	var commonN int
+	for pa, n := range pauxs {
+		switch {
+		case n > commonN:
+			commonPAux, commonN = pa, n
+		case n == commonN:
+			commonPAux = ""
+		}
+	}
+
+	// prefer roots holding a full size replica together with its cache, then
+	// those with the common p_aux; ties go to the heaviest root, unless the
+	// tied roots hold different p_aux
+	best, bestScore := "", -1
+	scores := map[string]int{}
+	for _, root := range order {
+		rs := roots[root]
+		score := 0
+		if rs.replica && rs.replicaSize == maxSize && validSectorSize(maxSize) {
+			score += 4
+		}
+		if rs.replica && rs.cache {
+			score += 2
+		}
+		if rs.paux != "" && rs.paux == commonPAux {
+			score++
+		}
+
+		scores[root] = score
+
+		if score > bestScore {
+			best, bestScore = root, score
+		}
+	}
+
+	rs := roots[best]
+	d.Split = !(rs.replica && rs.cache)
+
+	unranked := false
+	for _, root := range order {
+		if root != best && scores[root] == bestScore && roots[root].paux != rs.paux {
+			unranked = true
+		}
+	}
+	if !unranked {
+		d.Keep = best
+	}
+
+	var reason bytes.Buffer
+	switch {
+	case unranked:
+		reason.WriteString("the copies hold different p_aux and could not be ranked, check each with s-emulator before removing any")
+	case d.Split:
+		reason.WriteString("no root holds both the replica and its cache, move them together")
+	default:
+		reason.WriteString("holds the replica together with its cache")
+	}
+	if d.SizeMismatch {
+		_, _ = fmt.Fprintf(&reason, "; replica sizes differ, the %d bytes copy is kept", maxSize)
+	}
+	if d.PAuxMismatch && !unranked {
+		reason.WriteString("; p_aux differs between copies, check the kept copy with s-emulator before removing others")
+	}
+	d.Reason = reason.String()
+
+	return d, nil
+}
+
+// PathSize returns the size of a file, or the total size of the files in a
+// directory.
+func PathSize(p string) (int64, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if !st.IsDir() {
+		return st.Size(), nil
+	}
+
+	var size int64
+	err = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func validSectorSize(size int64) bool {
+	for _, ss := range []abi.SectorSize{2 << 10, 8 << 20, 512 << 20, 32 << 30, 64 << 30} {
+		if abi.SectorSize(size) == ss {
+			return true
+		}
+	}
+	return false
+}
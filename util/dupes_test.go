@@ -0,0 +1,47 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPAux(t *testing.T) {
+	commC := bytes.Repeat([]byte{1}, 32)
+	commRLast := bytes.Repeat([]byte{2}, 32)
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{name: "valid", data: append(append([]byte(nil), commC...), commRLast...), ok: true},
+		{name: "short", data: commC},
+		{name: "long", data: append(append(append([]byte(nil), commC...), commRLast...), 0)},
+		{name: "empty", data: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, "p_aux"), tc.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			pa, err := ReadPAux(dir)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", pa)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pa.CommC[:], commC) || !bytes.Equal(pa.CommRLast[:], commRLast) {
+				t.Errorf("got comm_c %x, comm_r_last %x", pa.CommC, pa.CommRLast)
+			}
+		})
+	}
+}
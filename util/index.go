@@ -0,0 +1,113 @@
+package util
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"golang.org/x/xerrors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// indexedTypes are the sector file types listed by the index.
+var indexedTypes = []storiface.SectorFileType{storiface.FTSealed, storiface.FTCache, storiface.FTUpdate, storiface.FTUpdateCache}
+
+// SectorIndex maps sectors to the storage roots holding their files. It is
+// built from one listing of each root instead of probing every root for every
+// sector.
+type SectorIndex struct {
+	sectors map[abi.SectorID]map[storiface.SectorFileType][]string
+}
+
+// BuildSectorIndex lists the sealed, cache and update directories of each path.
+// Roots are kept in the order of paths.
+func BuildSectorIndex(paths []StoragePath) (*SectorIndex, error) {
+	idx := &SectorIndex{
+		sectors: map[abi.SectorID]map[storiface.SectorFileType][]string{},
+	}
+
+	for _, sp := range paths {
+		for _, ft := range indexedTypes {
+			entries, err := os.ReadDir(filepath.Join(sp.Root, ft.String()))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, xerrors.Errorf("listing %s of %s: %w", ft, sp.Root, err)
+			}
+
+			for _, ent := range entries {
+				sid, err := storiface.ParseSectorID(ent.Name())
+				if err != nil {
+					continue
+				}
+
+				files, ok := idx.sectors[sid]
+				if !ok {
+					files = map[storiface.SectorFileType][]string{}
+					idx.sectors[sid] = files
+				}
+				files[ft] = append(files[ft], sp.Root)
+			}
+		}
+	}
+
+	log.Infow("sector index built", "paths", len(paths), "sectors", len(idx.sectors))
+	return idx, nil
+}
+
+// Roots returns the storage roots holding the file of the given type.
+func (i *SectorIndex) Roots(sid abi.SectorID, ft storiface.SectorFileType) []string {
+	return i.sectors[sid][ft]
+}
+
+// Path returns the path of the file of the given type in the root.
+func (i *SectorIndex) Path(root string, sid abi.SectorID, ft storiface.SectorFileType) string {
+	return filepath.Join(root, ft.String(), storiface.SectorName(sid))
+}
+
+// Sectors returns all indexed sectors, ordered by miner and number.
+func (i *SectorIndex) Sectors() []abi.SectorID {
+	out := make([]abi.SectorID, 0, len(i.sectors))
+	for sid := range i.sectors {
+		out = append(out, sid)
+	}
+
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Miner != out[b].Miner {
+			return out[a].Miner < out[b].Miner
+		}
+		return out[a].Number < out[b].Number
+	})
+	return out
+}
+
+// Duplicated tells whether a file of the sector exists in more than one root,
+// or whether its sealed and cache files are in different roots.
+func (i *SectorIndex) Duplicated(sid abi.SectorID) bool {
+	files := i.sectors[sid]
+	for _, roots := range files {
+		if len(roots) > 1 {
+			return true
+		}
+	}
+
+	sealed, cache := files[storiface.FTSealed], files[storiface.FTCache]
+	if len(sealed) == 1 && len(cache) == 1 && sealed[0] != cache[0] {
+		return true
+	}
+
+	update, updateCache := files[storiface.FTUpdate], files[storiface.FTUpdateCache]
+	return len(update) == 1 && len(updateCache) == 1 && update[0] != updateCache[0]
+}
+
+// Duplicates returns the sectors for which Duplicated is true.
+func (i *SectorIndex) Duplicates() []abi.SectorID {
+	var out []abi.SectorID
+	for _, sid := range i.Sectors() {
+		if i.Duplicated(sid) {
+			out = append(out, sid)
+		}
+	}
+	return out
+}
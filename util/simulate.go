@@ -3,53 +3,148 @@ package util
 import (
 	"context"
 	ffi "github.com/filecoin-project/filecoin-ffi"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/extern/sector-storage/ffiwrapper"
-	"github.com/filecoin-project/lotus/extern/sector-storage/ffiwrapper/basicfs"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
 	proof2 "github.com/filecoin-project/specs-actors/v2/actors/runtime/proof"
-	"github.com/filecoin-project/specs-storage/storage"
 	"golang.org/x/xerrors"
-	"strings"
+	"sync"
+	"time"
 )
 
 type Emulator interface {
 	GenerateWindowPoSt(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, []abi.SectorID, error)
+	GenerateWinningPoSt(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, error)
+}
+
+// SectorLocation records the storage directories in which the sealed and
+// cache files of a sector were found, along with the full file paths.
+type SectorLocation struct {
+	SealedRoot string
+	Sealed     string
+	CacheRoot  string
+	Cache      string
 }
 
 type Provider struct {
-	ps []ffiwrapper.SectorProvider
+	paths   []StoragePath
+	node    v1api.FullNode
+	tsk     types.TipSetKey
+	updated map[abi.SectorID]struct{}
+
+	indexOnce sync.Once
+	index     *SectorIndex
+	indexErr  error
+
+	lk      sync.Mutex
+	located map[abi.SectorID]SectorLocation
 }
 
 func NewProvider(sdir string) *Provider {
-	var ss = []ffiwrapper.SectorProvider{}
-
-	for _, d := range strings.Split(sdir, ",") {
-		bp := &basicfs.Provider{
-			Root: d,
-		}
+	return NewProviderFromPaths(ParseStoragePaths(sdir))
+}
 
-		ss = append(ss, bp)
+// NewProviderFromPaths looks sectors up in the paths, in the given order.
+func NewProviderFromPaths(paths []StoragePath) *Provider {
+	return &Provider{
+		paths:   paths,
+		located: map[abi.SectorID]SectorLocation{},
 	}
+}
 
-	return &Provider{
-		ps: ss,
+// UseChain lets the provider read the on-chain info of the sectors it proves,
+// at tsk. Sectors upgraded with SnapDeals, which have a sector key, are then
+// proven with their update and update-cache files instead of sealed and
+// cache.
+func (e *Provider) UseChain(node v1api.FullNode, tsk types.TipSetKey) *Provider {
+	e.node = node
+	e.tsk = tsk
+	return e
+}
+
+// UseUpdated marks the sectors as upgraded with SnapDeals, for when the
+// provider has no chain access. It is ignored once UseChain is set. Sectors
+// of several calls add up.
+func (e *Provider) UseUpdated(sectors []abi.SectorID) *Provider {
+	if e.updated == nil {
+		e.updated = map[abi.SectorID]struct{}{}
+	}
+	for _, sid := range sectors {
+		e.updated[sid] = struct{}{}
 	}
+	return e
+}
+
+func (e *Provider) Paths() []StoragePath {
+	return e.paths
+}
+
+// Index returns the index of the sector files in the storage paths. It is
+// built on first use and shared by all later proofs of the provider.
+func (e *Provider) Index() (*SectorIndex, error) {
+	e.indexOnce.Do(func() {
+		e.index, e.indexErr = BuildSectorIndex(e.paths)
+	})
+	return e.index, e.indexErr
+}
+
+// Location returns where the files of the sector were found during the last
+// proof generation which included it.
+func (e *Provider) Location(sid abi.SectorID) (SectorLocation, bool) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	loc, ok := e.located[sid]
+	return loc, ok
+}
+
+func (e *Provider) setLocation(sid abi.SectorID, loc SectorLocation) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	e.located[sid] = loc
+}
+
+// PoStPhases are the durations of the phases of a proof generation. Reading
+// the vanilla proofs and the SNARK both happen inside one ffi call, so they
+// are timed together as Prove.
+type PoStPhases struct {
+	Acquire time.Duration
+	Prove   time.Duration
+}
+
+// PhasedEmulator is an Emulator which can time the phases of the proof.
+type PhasedEmulator interface {
+	Emulator
+	GenerateWindowPoStPhases(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, []abi.SectorID, PoStPhases, error)
 }
 
 func (e *Provider) GenerateWindowPoSt(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, []abi.SectorID, error) {
+	proof, faulty, skipped, _, err := e.GenerateWindowPoStPhases(ctx, minerID, sectorInfo, randomness)
+	return proof, faulty, skipped, err
+}
+
+func (e *Provider) GenerateWindowPoStPhases(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, []abi.SectorID, PoStPhases, error) {
+	var phases PoStPhases
+
 	randomness[31] &= 0x3f
-	privsectors, skipped, done, err := e.pubSectorToPriv(ctx, minerID, sectorInfo, nil, abi.RegisteredSealProof.RegisteredWindowPoStProof)
+	start := time.Now()
+	privsectors, skipped, err := e.pubSectorToPriv(ctx, minerID, sectorInfo, nil, abi.RegisteredSealProof.RegisteredWindowPoStProof)
+	phases.Acquire = time.Since(start)
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("gathering sector info: %w", err)
+		return nil, nil, nil, phases, xerrors.Errorf("gathering sector info: %w", err)
 	}
-	defer done()
 
 	if len(privsectors.Values()) == 0 {
-		return nil, nil, skipped, nil
+		return nil, nil, skipped, phases, nil
 	}
 
+	start = time.Now()
 	proof, faulty, err := ffi.GenerateWindowPoSt(minerID, privsectors, randomness)
+	phases.Prove = time.Since(start)
 
 	var faultyIDs []abi.SectorID
 	for _, f := range faulty {
@@ -59,20 +154,41 @@ func (e *Provider) GenerateWindowPoSt(ctx context.Context, minerID abi.ActorID,
 		})
 	}
 
-	return proof, faultyIDs, skipped, err
+	return proof, faultyIDs, skipped, phases, err
+}
+
+// GenerateWinningPoSt proves the challenged sectors like the miner does when
+// it wins a block. Unlike the miner, it reports the sectors whose files are
+// missing instead of only failing.
+func (e *Provider) GenerateWinningPoSt(ctx context.Context, minerID abi.ActorID, sectorInfo []proof2.SectorInfo, randomness abi.PoStRandomness) ([]proof2.PoStProof, []abi.SectorID, error) {
+	randomness[31] &= 0x3f
+	privsectors, skipped, err := e.pubSectorToPriv(ctx, minerID, sectorInfo, nil, abi.RegisteredSealProof.RegisteredWinningPoStProof)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("gathering sector info: %w", err)
+	}
+
+	if len(skipped) > 0 {
+		return nil, skipped, xerrors.Errorf("sector files not found: %v", skipped)
+	}
+
+	proof, err := ffi.GenerateWinningPoSt(minerID, privsectors, randomness)
+	return proof, nil, err
 }
 
-func (e *Provider) pubSectorToPriv(ctx context.Context, mid abi.ActorID, sectorInfo []proof2.SectorInfo, faults []abi.SectorNumber, rpt func(abi.RegisteredSealProof) (abi.RegisteredPoStProof, error)) (ffi.SortedPrivateSectorInfo, []abi.SectorID, func(), error) {
+func (e *Provider) pubSectorToPriv(ctx context.Context, mid abi.ActorID, sectorInfo []proof2.SectorInfo, faults []abi.SectorNumber, rpt func(abi.RegisteredSealProof) (abi.RegisteredPoStProof, error)) (ffi.SortedPrivateSectorInfo, []abi.SectorID, error) {
 	fmap := map[abi.SectorNumber]struct{}{}
 	for _, fault := range faults {
 		fmap[fault] = struct{}{}
 	}
 
-	var doneFuncs []func()
-	done := func() {
-		for _, df := range doneFuncs {
-			df()
-		}
+	idx, err := e.Index()
+	if err != nil {
+		return ffi.SortedPrivateSectorInfo{}, nil, err
+	}
+
+	updated, err := e.updatedSectors(ctx, mid, sectorInfo)
+	if err != nil {
+		return ffi.SortedPrivateSectorInfo{}, nil, err
 	}
 
 	var skipped []abi.SectorID
@@ -82,55 +198,86 @@ func (e *Provider) pubSectorToPriv(ctx context.Context, mid abi.ActorID, sectorI
 			continue
 		}
 
-		sid := storage.SectorRef{
-			ID:        abi.SectorID{Miner: mid, Number: s.SectorNumber},
-			ProofType: s.SealProof,
+		sealedType, cacheType := storiface.FTSealed, storiface.FTCache
+		if _, ok := updated[s.SectorNumber]; ok {
+			sealedType, cacheType = storiface.FTUpdate, storiface.FTUpdateCache
 		}
 
-		var paths storiface.SectorPaths
-		d := func() {}
-		var err error
-
-		cacheFilesExist := false
-		sealedFileExist := false
-		for _, provider := range e.ps {
-			var filePath storiface.SectorPaths
-			if !cacheFilesExist {
-				filePath, d, err = provider.AcquireSector(ctx, sid, storiface.FTCache, 0, storiface.PathStorage)
-				if err == nil {
-					cacheFilesExist = true
-					paths.Cache = filePath.Cache
-					doneFuncs = append(doneFuncs, d)
-				}
-			}
-			if !sealedFileExist {
-				filePath, d, err = provider.AcquireSector(ctx, sid, storiface.FTSealed, 0, storiface.PathStorage)
-				if err == nil {
-					sealedFileExist = true
-					paths.Sealed = filePath.Sealed
-					doneFuncs = append(doneFuncs, d)
-				}
-			}
+		sid := abi.SectorID{Miner: mid, Number: s.SectorNumber}
+		if idx.Duplicated(sid) {
+			log.Warnw("sector files exist in more than one storage path, using the first", "sector", sid,
+				sealedType.String(), idx.Roots(sid, sealedType), cacheType.String(), idx.Roots(sid, cacheType))
+		}
+
+		var loc SectorLocation
+		if roots := idx.Roots(sid, cacheType); len(roots) > 0 {
+			loc.CacheRoot, loc.Cache = roots[0], idx.Path(roots[0], sid, cacheType)
 		}
+		if roots := idx.Roots(sid, sealedType); len(roots) > 0 {
+			loc.SealedRoot, loc.Sealed = roots[0], idx.Path(roots[0], sid, sealedType)
+		}
+
+		e.setLocation(sid, loc)
 
-		if !cacheFilesExist || !sealedFileExist {
-			skipped = append(skipped, sid.ID)
+		if loc.Cache == "" || loc.Sealed == "" {
+			skipped = append(skipped, sid)
 			continue
 		}
 
 		postProofType, err := rpt(s.SealProof)
 		if err != nil {
-			done()
-			return ffi.SortedPrivateSectorInfo{}, nil, nil, xerrors.Errorf("acquiring registered PoSt proof from sector info %+v: %w", s, err)
+			return ffi.SortedPrivateSectorInfo{}, nil, xerrors.Errorf("acquiring registered PoSt proof from sector info %+v: %w", s, err)
 		}
 
 		out = append(out, ffi.PrivateSectorInfo{
-			CacheDirPath:     paths.Cache,
+			CacheDirPath:     loc.Cache,
 			PoStProofType:    postProofType,
-			SealedSectorPath: paths.Sealed,
+			SealedSectorPath: loc.Sealed,
 			SectorInfo:       s,
 		})
 	}
 
-	return ffi.NewSortedPrivateSectorInfo(out...), skipped, done, nil
+	return ffi.NewSortedPrivateSectorInfo(out...), skipped, nil
+}
+
+// updatedSectors returns the sectors which have a sector key on chain, that
+// is which were upgraded with SnapDeals. Without chain access only those
+// given to UseUpdated are.
+func (e *Provider) updatedSectors(ctx context.Context, mid abi.ActorID, sectorInfo []proof2.SectorInfo) (map[abi.SectorNumber]struct{}, error) {
+	if len(sectorInfo) == 0 {
+		return nil, nil
+	}
+
+	if e.node == nil {
+		updated := map[abi.SectorNumber]struct{}{}
+		for _, s := range sectorInfo {
+			if _, ok := e.updated[abi.SectorID{Miner: mid, Number: s.SectorNumber}]; ok {
+				updated[s.SectorNumber] = struct{}{}
+			}
+		}
+		return updated, nil
+	}
+
+	maddr, err := address.NewIDAddress(uint64(mid))
+	if err != nil {
+		return nil, err
+	}
+
+	sectors := bitfield.New()
+	for _, s := range sectorInfo {
+		sectors.Set(uint64(s.SectorNumber))
+	}
+
+	infos, err := e.node.StateMinerSectors(ctx, maddr, &sectors, e.tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("getting sector infos: %w", err)
+	}
+
+	updated := map[abi.SectorNumber]struct{}{}
+	for _, info := range infos {
+		if info.SectorKeyCID != nil {
+			updated[info.SectorNumber] = struct{}{}
+		}
+	}
+	return updated, nil
 }
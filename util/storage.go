@@ -0,0 +1,173 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StoragePath describes a sector storage root, as configured for lotus-miner
+// in its sectorstore.json.
+type StoragePath struct {
+	ID       string
+	Root     string
+	Weight   uint64
+	CanSeal  bool
+	CanStore bool
+	ReadOnly bool
+}
+
+// storageConfig is the storage.json of a lotus-miner repo.
+type storageConfig struct {
+	StoragePaths []struct {
+		Path string
+	}
+}
+
+// storageMeta is the sectorstore.json of a storage path.
+type storageMeta struct {
+	ID       string
+	Weight   uint64
+	CanSeal  bool
+	CanStore bool
+	ReadOnly bool
+}
+
+// ParseStoragePaths turns a comma separated list of directories into storage
+// paths which can store sectors.
+func ParseStoragePaths(sdir string) []StoragePath {
+	var out []StoragePath
+	for _, d := range strings.Split(sdir, ",") {
+		if d == "" {
+			continue
+		}
+
+		out = append(out, StoragePath{
+			Root:     d,
+			Weight:   10,
+			CanStore: true,
+		})
+	}
+	return out
+}
+
+// RepoStoragePaths reads the storage paths of a lotus-miner repo from its
+// storage.json and the sectorstore.json of each path.
+func RepoStoragePaths(repo string) ([]StoragePath, error) {
+	repo, err := homedir.Expand(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(repo, "storage.json"))
+	if err != nil {
+		return nil, xerrors.Errorf("reading storage config: %w", err)
+	}
+
+	var cfg storageConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, xerrors.Errorf("decoding storage config: %w", err)
+	}
+
+	var out []StoragePath
+	for _, p := range cfg.StoragePaths {
+		root, err := homedir.Expand(p.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(root, "sectorstore.json"))
+		if err != nil {
+			return nil, xerrors.Errorf("reading storage metadata of %s: %w", root, err)
+		}
+
+		var meta storageMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, xerrors.Errorf("decoding storage metadata of %s: %w", root, err)
+		}
+
+		out = append(out, StoragePath{
+			ID:       meta.ID,
+			Root:     root,
+			Weight:   meta.Weight,
+			CanSeal:  meta.CanSeal,
+			CanStore: meta.CanStore,
+			ReadOnly: meta.ReadOnly,
+		})
+	}
+
+	return out, nil
+}
+
+// MinerStoragePaths asks the miner for its storage paths. Only paths attached
+// to the miner process itself have a local root; paths of workers are left out.
+func MinerStoragePaths(ctx context.Context, minerApi api.StorageMiner) ([]StoragePath, error) {
+	local, err := minerApi.StorageLocal(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("getting local storage: %w", err)
+	}
+
+	decls, err := minerApi.StorageList(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("listing storage: %w", err)
+	}
+
+	var out []StoragePath
+	for id := range decls {
+		root, ok := local[id]
+		if !ok {
+			log.Warnw("storage path is not attached to the miner, skipping", "id", id)
+			continue
+		}
+
+		si, err := minerApi.StorageInfo(ctx, id)
+		if err != nil {
+			return nil, xerrors.Errorf("getting storage info of %s: %w", id, err)
+		}
+
+		sp := StoragePath{
+			ID:       string(id),
+			Root:     root,
+			Weight:   si.Weight,
+			CanSeal:  si.CanSeal,
+			CanStore: si.CanStore,
+		}
+
+		// the api doesn't tell whether a path is read-only, sectorstore.json might
+		if b, err := ioutil.ReadFile(filepath.Join(root, "sectorstore.json")); err == nil {
+			var meta storageMeta
+			if err := json.Unmarshal(b, &meta); err == nil {
+				sp.ReadOnly = meta.ReadOnly
+			}
+		}
+
+		out = append(out, sp)
+	}
+
+	return out, nil
+}
+
+// SelectStoragePaths keeps the paths which can store sectors, and also those
+// which can only seal if withSeal is set. The result is ordered by weight,
+// heaviest first, so that sectors are looked up in the same order the miner
+// prefers to place them.
+func SelectStoragePaths(paths []StoragePath, withSeal bool) []StoragePath {
+	var out []StoragePath
+	for _, p := range paths {
+		if p.CanStore || (withSeal && p.CanSeal) {
+			out = append(out, p)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Weight > out[j].Weight
+	})
+
+	return out
+}
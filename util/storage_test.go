@@ -0,0 +1,64 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStoragePaths(t *testing.T) {
+	tests := []struct {
+		sdir string
+		want []string
+	}{
+		{sdir: "", want: nil},
+		{sdir: "/storage1", want: []string{"/storage1"}},
+		{sdir: "/storage1,/storage2", want: []string{"/storage1", "/storage2"}},
+		{sdir: "/storage1,,/storage2,", want: []string{"/storage1", "/storage2"}},
+	}
+
+	for _, tc := range tests {
+		var got []string
+		for _, p := range ParseStoragePaths(tc.sdir) {
+			if !p.CanStore || p.CanSeal {
+				t.Errorf("%q: %s can't store sectors", tc.sdir, p.Root)
+			}
+			got = append(got, p.Root)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.sdir, got, tc.want)
+		}
+	}
+}
+
+func TestSelectStoragePaths(t *testing.T) {
+	paths := []StoragePath{
+		{Root: "/seal", Weight: 10, CanSeal: true},
+		{Root: "/light", Weight: 5, CanStore: true},
+		{Root: "/heavy", Weight: 20, CanStore: true},
+		{Root: "/both", Weight: 10, CanSeal: true, CanStore: true},
+		{Root: "/other", Weight: 10, CanStore: true},
+		{Root: "/none", Weight: 30},
+	}
+
+	tests := []struct {
+		name     string
+		withSeal bool
+		want     []string
+	}{
+		// equal weights keep the order they were given in
+		{name: "store", want: []string{"/heavy", "/both", "/other", "/light"}},
+		{name: "with seal", withSeal: true, want: []string{"/heavy", "/seal", "/both", "/other", "/light"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, p := range SelectStoragePaths(paths, tc.withSeal) {
+				got = append(got, p.Root)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/xerrors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// StoreConfig is the config of one merkle tree or layer store in t_aux.
+type StoreConfig struct {
+	Path          string
+	ID            string
+	Size          *uint64
+	RowsToDiscard uint64
+}
+
+// TAux is the content of the t_aux file in a sector cache directory, which
+// the proofs write with bincode.
+type TAux struct {
+	Labels    []StoreConfig
+	TreeD     StoreConfig
+	TreeRLast StoreConfig
+	TreeC     StoreConfig
+}
+
+// ReadTAux reads and decodes the t_aux file of the cache directory.
+func ReadTAux(cacheDir string) (*TAux, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cacheDir, "t_aux"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(b)
+
+	var ta TAux
+	n, err := readU64(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading labels: %w", err)
+	}
+	// a store config takes at least 25 bytes
+	if n > uint64(r.Len())/25 {
+		return nil, xerrors.Errorf("t_aux claims %d labels in %d bytes", n, r.Len())
+	}
+	ta.Labels = make([]StoreConfig, n)
+	for i := range ta.Labels {
+		if ta.Labels[i], err = readStoreConfig(r); err != nil {
+			return nil, xerrors.Errorf("reading label %d: %w", i, err)
+		}
+	}
+
+	for _, sc := range []*StoreConfig{&ta.TreeD, &ta.TreeRLast, &ta.TreeC} {
+		if *sc, err = readStoreConfig(r); err != nil {
+			return nil, xerrors.Errorf("reading tree config: %w", err)
+		}
+	}
+
+	if r.Len() != 0 {
+		return nil, xerrors.Errorf("t_aux has %d trailing bytes", r.Len())
+	}
+
+	return &ta, nil
+}
+
+func readStoreConfig(r *bytes.Reader) (StoreConfig, error) {
+	var sc StoreConfig
+	var err error
+
+	if sc.Path, err = readString(r); err != nil {
+		return sc, err
+	}
+	if sc.ID, err = readString(r); err != nil {
+		return sc, err
+	}
+
+	some, err := r.ReadByte()
+	if err != nil {
+		return sc, err
+	}
+	switch some {
+	case 0:
+	case 1:
+		size, err := readU64(r)
+		if err != nil {
+			return sc, err
+		}
+		sc.Size = &size
+	default:
+		return sc, xerrors.Errorf("invalid option tag %d", some)
+	}
+
+	sc.RowsToDiscard, err = readU64(r)
+	return sc, err
+}
+
+func readU64(r io.Reader) (uint64, error) {
+	var v uint64
+	err := binary.Read(r, binary.LittleEndian, &v)
+	return v, err
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readU64(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", xerrors.Errorf("string of %d bytes in %d left", n, r.Len())
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encodeStoreConfig writes sc the way bincode does.
+func encodeStoreConfig(buf *bytes.Buffer, sc StoreConfig) {
+	for _, s := range []string{sc.Path, sc.ID} {
+		_ = binary.Write(buf, binary.LittleEndian, uint64(len(s)))
+		buf.WriteString(s)
+	}
+	if sc.Size == nil {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		_ = binary.Write(buf, binary.LittleEndian, *sc.Size)
+	}
+	_ = binary.Write(buf, binary.LittleEndian, sc.RowsToDiscard)
+}
+
+func encodeTAux(ta TAux) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(ta.Labels)))
+	for _, sc := range ta.Labels {
+		encodeStoreConfig(buf, sc)
+	}
+	for _, sc := range []StoreConfig{ta.TreeD, ta.TreeRLast, ta.TreeC} {
+		encodeStoreConfig(buf, sc)
+	}
+	return buf.Bytes()
+}
+
+func TestReadTAux(t *testing.T) {
+	size := func(n uint64) *uint64 { return &n }
+
+	valid := TAux{
+		Labels: []StoreConfig{
+			{Path: "/cache/s-t01000-1", ID: "layer-1", Size: size(1 << 30)},
+			{Path: "/cache/s-t01000-1", ID: "layer-2", Size: size(1 << 30)},
+		},
+		TreeD:     StoreConfig{Path: "/cache/s-t01000-1", ID: "tree-d", Size: size(1<<31 - 1)},
+		TreeRLast: StoreConfig{Path: "/cache/s-t01000-1", ID: "tree-r-last", Size: size(4681), RowsToDiscard: 2},
+		TreeC:     StoreConfig{Path: "/cache/s-t01000-1", ID: "tree-c"},
+	}
+	b := encodeTAux(valid)
+
+	badTag := append([]byte(nil), b...)
+	// the option tag of the size of the first label
+	badTag[8+8+len("/cache/s-t01000-1")+8+len("layer-1")] = 2
+
+	tests := []struct {
+		name string
+		data []byte
+		want *TAux
+	}{
+		{name: "valid", data: b, want: &valid},
+		{name: "no labels", data: encodeTAux(TAux{TreeD: valid.TreeD, TreeRLast: valid.TreeRLast, TreeC: valid.TreeC}),
+			want: &TAux{Labels: []StoreConfig{}, TreeD: valid.TreeD, TreeRLast: valid.TreeRLast, TreeC: valid.TreeC}},
+		{name: "trailing bytes", data: append(append([]byte(nil), b...), 0)},
+		{name: "truncated", data: b[:len(b)-1]},
+		{name: "invalid option tag", data: badTag},
+		{name: "too many labels", data: append([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, b[8:]...)},
+		{name: "empty", data: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, "t_aux"), tc.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadTAux(dir)
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadTAuxMissing(t *testing.T) {
+	if _, err := ReadTAux(t.TempDir()); err == nil {
+		t.Fatal("expected an error without t_aux")
+	}
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"strings"
+)
+
+var (
+	TipSetFlag = &cli.StringFlag{
+		Name:  "tipset",
+		Usage: "read all chain state at this tipset, its block cids separated by commas, instead of the chain head",
+	}
+	HeightFlag = &cli.Int64Flag{
+		Name:  "height",
+		Usage: "read all chain state at the tipset at this height, instead of the chain head",
+	}
+)
+
+// GetTipSet returns the tipset given by --tipset or --height, else the chain
+// head. Every state read of a run uses it, so that the results can't mix
+// tipsets when the head moves or reorgs.
+func GetTipSet(ctx context.Context, cctx *cli.Context, nodeApi v1api.FullNode) (*types.TipSet, error) {
+	if cctx.IsSet(TipSetFlag.Name) && cctx.IsSet(HeightFlag.Name) {
+		return nil, xerrors.New("--tipset and --height are mutually exclusive")
+	}
+
+	var ts *types.TipSet
+	switch {
+	case cctx.IsSet(TipSetFlag.Name):
+		var cids []cid.Cid
+		for _, s := range strings.Split(cctx.String(TipSetFlag.Name), ",") {
+			c, err := cid.Parse(strings.TrimSpace(s))
+			if err != nil {
+				return nil, xerrors.Errorf("parsing block cid %s: %w", s, err)
+			}
+			cids = append(cids, c)
+		}
+
+		var err error
+		if ts, err = nodeApi.ChainGetTipSet(ctx, types.NewTipSetKey(cids...)); err != nil {
+			return nil, xerrors.Errorf("getting tipset: %w", err)
+		}
+	case cctx.IsSet(HeightFlag.Name):
+		head, err := nodeApi.ChainHead(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		height := abi.ChainEpoch(cctx.Int64(HeightFlag.Name))
+		if height > head.Height() {
+			return nil, xerrors.Errorf("height %d is above the chain head %d", height, head.Height())
+		}
+		if ts, err = nodeApi.ChainGetTipSetByHeight(ctx, height, head.Key()); err != nil {
+			return nil, xerrors.Errorf("getting tipset at %d: %w", height, err)
+		}
+	default:
+		var err error
+		if ts, err = nodeApi.ChainHead(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infow("reading chain state at", "height", ts.Height(), "tipset", ts.Key())
+	return ts, nil
+}
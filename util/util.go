@@ -9,21 +9,17 @@ import (
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/types"
 	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
+	"strings"
 )
 
-func GetSectorSize(ctx context.Context, nodeApi v1api.FullNode, maddr address.Address) (abi.SectorSize, network.Version, error) {
-	head, err := nodeApi.ChainHead(context.Background())
-	if err != nil {
-		return 0, 0, err
-	}
-
-	tsk, err := types.TipSetKeyFromBytes(head.Key().Bytes())
-	if err != nil {
-		return 0, 0, err
-	}
+var log = logging.Logger("util")
 
+// GetSectorSizeAt returns the sector size and the network version of the
+// miner, both read at tsk.
+func GetSectorSizeAt(ctx context.Context, nodeApi v1api.FullNode, maddr address.Address, tsk types.TipSetKey) (abi.SectorSize, network.Version, error) {
 	mi, err := nodeApi.StateMinerInfo(ctx, maddr, tsk)
 	if err != nil {
 		return 0, 0, err
@@ -49,6 +45,9 @@ func GetSectorSize(ctx context.Context, nodeApi v1api.FullNode, maddr address.Ad
 
 func GetActorAddress(cctx *cli.Context) (maddr address.Address, err error) {
 	if cctx.IsSet("actor") {
+		if strings.Contains(cctx.String("actor"), ",") {
+			return maddr, xerrors.New("this command takes only one --actor")
+		}
 		maddr, err = address.NewFromString(cctx.String("actor"))
 		if err != nil {
 			return maddr, err
@@ -69,3 +68,31 @@ func GetActorAddress(cctx *cli.Context) (maddr address.Address, err error) {
 
 	return maddr, nil
 }
+
+// GetActorAddresses returns the actors listed in --actor, separated by
+// commas, or the actor of the miner.
+func GetActorAddresses(cctx *cli.Context) ([]address.Address, error) {
+	if !cctx.IsSet("actor") {
+		maddr, err := GetActorAddress(cctx)
+		if err != nil {
+			return nil, err
+		}
+		return []address.Address{maddr}, nil
+	}
+
+	var out []address.Address
+	seen := map[address.Address]struct{}{}
+	for _, s := range strings.Split(cctx.String("actor"), ",") {
+		maddr, err := address.NewFromString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, xerrors.Errorf("parsing actor %s: %w", s, err)
+		}
+		if _, ok := seen[maddr]; ok {
+			continue
+		}
+		seen[maddr] = struct{}{}
+		out = append(out, maddr)
+	}
+
+	return out, nil
+}